@@ -0,0 +1,748 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// walkFS walks the file tree rooted at root in fsys, calling fn for each
+// file or directory in the tree, including root, in lexical order. Like
+// filepath.Walk, fn may return fs.SkipDir to skip a directory. Names are
+// '/'-separated and passed to fn as full paths within fsys.
+func walkFS(fsys FileSystem, root string, fn func(name string, info fs.FileInfo, err error) error) error {
+	f, err := fsys.Open(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkFSDir(fsys, root, info, fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkFSDir(fsys FileSystem, name string, info fs.FileInfo, fn func(string, fs.FileInfo, error) error) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+
+	f, err := fsys.Open(name)
+	var list []fs.FileInfo
+	if err == nil {
+		list, err = f.Readdir(-1)
+		f.Close()
+	}
+	err1 := fn(name, info, err)
+	if err != nil || err1 != nil {
+		// The caller decides whether a directory that can't be read
+		// is fatal; either way there's nothing to descend into.
+		return err1
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	for _, fi := range list {
+		err = walkFSDir(fsys, path.Join(name, fi.Name()), fi, fn)
+		if err != nil {
+			if !fi.IsDir() || err != fs.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveRoot checks that dirpath is a readable directory in fsys, replying
+// with an error and returning false if it isn't.
+func archiveRoot(w http.ResponseWriter, fsys FileSystem, dirpath string) bool {
+	f, err := fsys.Open(dirpath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return false
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return false
+	}
+	if !d.IsDir() {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// archiveName returns the download name for an archive of dirpath.
+func archiveName(dirpath string) string {
+	if name := path.Base(dirpath); name != "/" && name != "." {
+		return name
+	}
+	return "root"
+}
+
+// archiveRel returns p relative to the archived directory dirpath.
+func archiveRel(dirpath, p string) string {
+	if dirpath == "/" {
+		return p[1:]
+	}
+	return p[len(dirpath)+1:]
+}
+
+// archiveFormats are the formats of ?archive=, by name, which is also the
+// extension of their files.
+var archiveFormats = map[string]struct {
+	ctype string
+	// minLevel and maxLevel bound the compression levels ?level= takes.
+	minLevel, maxLevel int
+}{
+	"tar":     {"application/x-tar", 0, 0},
+	"tar.gz":  {"application/gzip", 0, 9},
+	"tar.zst": {"application/zstd", 1, 22},
+	"tar.xz":  {"application/x-xz", 0, len(xzDictCaps) - 1},
+	"zip":     {"application/zip", 0, 9},
+}
+
+// defaultArchiveStore is what zips store without compressing by default:
+// media and archives, which are compressed already.
+const defaultArchiveStore = "image/jpeg,image/png,image/gif,image/webp,image/avif,.heic,video/*,audio/*," +
+	".zip,.gz,.tgz,.bz2,.xz,.zst,.7z,.rar,.jar,.apk,.epub,.docx,.xlsx,.pptx,.odt"
+
+// xzDictCaps are the dictionary sizes of the xz levels. The dictionary is
+// all the encoder lets set of what the presets of the xz tool differ in, so
+// there is a level for each size they use rather than one per preset, from
+// that of -0 to that of -9; the default is that of -6.
+var xzDictCaps = [...]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter interface {
+	// writeEntry adds e, reading its contents from r if it's a regular
+	// file; r is nil otherwise.
+	writeEntry(e *archiveEntry, r io.Reader) error
+	// Close finishes the archive, without closing what it's written to.
+	Close() error
+}
+
+// newArchiveWriter returns a writer of archives in format to w, compressed
+// at level, or -1 for the default of the format. Zips store the files
+// store lists rather than compress them; compressed tars are compressed
+// as a whole, so it doesn't apply to them.
+func newArchiveWriter(w io.Writer, format string, level int, store typeList) (archiveWriter, error) {
+	var c io.WriteCloser
+	var err error
+	switch format {
+	case "zip":
+		zw := zip.NewWriter(w)
+		if level > 0 {
+			zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(out, level)
+			})
+		}
+		return &zipArchive{zw: zw, level: level, store: store}, nil
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}, nil
+	case "tar.gz":
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		c, err = gzip.NewWriterLevel(w, level)
+	case "tar.zst":
+		zl := zstd.SpeedDefault
+		if level >= 0 {
+			zl = zstd.EncoderLevelFromZstd(level)
+		}
+		// One goroutine per archive rather than one per CPU.
+		c, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zl), zstd.WithEncoderConcurrency(1))
+	case "tar.xz":
+		var cfg xz.WriterConfig
+		if level >= 0 {
+			cfg.DictCap = xzDictCaps[level]
+		}
+		c, err = cfg.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchive{tw: tar.NewWriter(c), c: c}, nil
+}
+
+// tarArchive writes tars, compressed by c if it isn't nil.
+type tarArchive struct {
+	tw *tar.Writer
+	c  io.WriteCloser
+}
+
+// tarHeader returns the tar header of e. It is PAX, for long and non-ASCII
+// names, with the mode, owner and mtime of the file, but not its atime
+// and ctime, so archives of the same files come out the same.
+func tarHeader(e *archiveEntry) (*tar.Header, error) {
+	h, err := tar.FileInfoHeader(e.info, e.link)
+	if err != nil {
+		return nil, err
+	}
+	h.Name = e.rel
+	if e.info.IsDir() {
+		h.Name += "/"
+	}
+	h.Format = tar.FormatPAX
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}
+	return h, nil
+}
+
+func (a *tarArchive) writeEntry(e *archiveEntry, r io.Reader) error {
+	h, err := tarHeader(e)
+	if err != nil {
+		return err
+	}
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	return copyFile(a.tw, r, e.rel, e.info)
+}
+
+func (a *tarArchive) Close() error {
+	err := a.tw.Close()
+	if a.c != nil {
+		if cerr := a.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// zipArchive writes zips, deflating the files zipStores says to at level.
+type zipArchive struct {
+	zw    *zip.Writer
+	level int
+	store typeList
+}
+
+// zipStores reports whether zips compressed at level store e rather than
+// deflate it, which they do for all at level 0, and for what isn't a
+// regular file or is of a type store lists otherwise.
+func zipStores(level int, store typeList, e *archiveEntry) bool {
+	return level == 0 || !e.info.Mode().IsRegular() || store.matches(e.rel, mime.TypeByExtension(path.Ext(e.rel)))
+}
+
+// writeEntry writes directories as empty entries named with a slash, and
+// symlinks with their target as contents, as zip tools do.
+func (a *zipArchive) writeEntry(e *archiveEntry, r io.Reader) error {
+	h, err := zip.FileInfoHeader(e.info)
+	if err != nil {
+		return err
+	}
+	h.Name = e.rel
+	if e.info.IsDir() {
+		h.Name += "/"
+	}
+	h.Modified = zipModTime(e.info)
+	h.Method = zip.Deflate
+	if zipStores(a.level, a.store, e) {
+		h.Method = zip.Store
+	}
+	zf, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r != nil:
+		return copyFile(zf, r, e.rel, e.info)
+	case e.link != "":
+		_, err = io.WriteString(zf, e.link)
+	}
+	return err
+}
+
+// zipModTime returns the mtime zips have for the file with info: in UTC,
+// as archive/zip keeps them, and not before 1980, which MS-DOS times can't
+// be.
+func zipModTime(info fs.FileInfo) time.Time {
+	t := info.ModTime().UTC()
+	if epoch := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); t.Before(epoch) {
+		return epoch
+	}
+	return t
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// copyFile copies the file rel with info from r to w, checking that it is
+// still the size info says, which archive headers were written with.
+func copyFile(w io.Writer, r io.Reader, rel string, info fs.FileInfo) error {
+	n, err := io.Copy(w, r)
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("mismatch of size with %s", rel)
+	}
+	return err
+}
+
+// serveArchive replies to ?archive=FORMAT on the directory name with an
+// archive of the files in it, compressed at the level of &level=N if the
+// format is compressed. A POST archives only the files and directories of
+// its path form values instead, which are relative to name.
+func (h *fileHandler) serveArchive(w http.ResponseWriter, r *http.Request, name string) {
+	format := r.URL.Query().Get("archive")
+	f, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "400 Bad Request: unknown archive format", http.StatusBadRequest)
+		return
+	}
+	maxLevel := f.maxLevel
+	if format == "tar.zst" && h.archiveZstdMax > 0 {
+		maxLevel = min(maxLevel, h.archiveZstdMax)
+	}
+	level := -1
+	if s := r.URL.Query().Get("level"); s != "" {
+		n, err := strconv.Atoi(s)
+		if maxLevel == 0 {
+			http.Error(w, "400 Bad Request: "+format+" is not compressed", http.StatusBadRequest)
+			return
+		}
+		if err != nil || n < f.minLevel || n > maxLevel {
+			http.Error(w, fmt.Sprintf("400 Bad Request: level of %s must be %d to %d", format, f.minLevel, maxLevel), http.StatusBadRequest)
+			return
+		}
+		level = n
+	}
+	if !archiveRoot(w, h.root, name) {
+		return
+	}
+	roots := []string{name}
+	if r.Method == "POST" {
+		var err error
+		if roots, err = archiveSelection(h.root, name, r, h.archiveScope.skip); err != nil {
+			msg, code := toHTTPError(err)
+			if errors.Is(err, errBadSelection) {
+				msg, code = "400 Bad Request: "+err.Error(), http.StatusBadRequest
+			}
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	entries, err := archiveEntries(h.root, name, roots, h.archiveScope)
+	if err != nil {
+		log.Println("archive:", name+":", err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	// Writers may start with a header of their own, so set these first.
+	w.Header().Set("Content-Type", f.ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName(name) + "." + format}))
+	if l, err := newArchiveLayout(h.root, h.archiveCRCs, format, level, h.archiveStore, entries); err != nil || l != nil {
+		if err != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lr := l.reader()
+		defer lr.Close()
+		w.Header().Set("ETag", l.etag)
+		ServeContent(w, r, "", time.Time{}, lr)
+		archiveFailed(r, name, lr.err)
+		return
+	}
+	aw, err := newArchiveWriter(w, format, level, h.archiveStore)
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = writeArchive(aw, h.root, entries)
+	if err == nil {
+		err = aw.Close()
+	}
+	archiveFailed(r, name, err)
+}
+
+// archiveFailed logs err, if the archive of name being sent failed with
+// one, and aborts the response so the download fails rather than end as if
+// the archive were complete.
+func archiveFailed(r *http.Request, name string, err error) {
+	if err == nil {
+		return
+	}
+	if r.Context().Err() == nil {
+		// Not just the client going away.
+		log.Println("archive:", name+":", err)
+	}
+	panic(http.ErrAbortHandler)
+}
+
+var errBadSelection = errors.New("invalid selection")
+
+// archiveSelection returns the paths in the directory dirpath of fsys that
+// the path form values of r select, sorted, without duplicates or paths
+// within other selected directories. Each must be a relative path within
+// dirpath that exists; with skip, those that can't be read are left to
+// archiveEntries to list.
+func archiveSelection(fsys FileSystem, dirpath string, r *http.Request, skip bool) ([]string, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadSelection, err)
+	}
+	selected := map[string]bool{}
+	for _, rel := range r.PostForm["path"] {
+		p := path.Clean(rel)
+		if rel == "" || path.IsAbs(rel) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("%w: path %q", errBadSelection, rel)
+		}
+		selected[p] = true
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("%w: no paths", errBadSelection)
+	}
+
+	var roots []string
+	for p := range selected {
+		within := false
+		for d := path.Dir(p); d != "." && !within; d = path.Dir(d) {
+			within = selected[d]
+		}
+		if within {
+			continue
+		}
+		full := path.Join(dirpath, p)
+		f, err := fsys.Open(full)
+		if err == nil {
+			_, err = f.Stat()
+			f.Close()
+		}
+		if err != nil && (!skip || errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+		roots = append(roots, full)
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// archiveEntry is a file, directory or symlink to archive: name in the
+// FileSystem, as rel in the archive, or data if it's made up rather than
+// read. link is the target of symlinks.
+type archiveEntry struct {
+	name string
+	rel  string
+	info fs.FileInfo
+	data []byte
+	link string
+}
+
+// errorsEntry is the name of the archive entry listing what was left out of
+// it for errors, unless errorsName has to pick another.
+const errorsEntry = "ERRORS.txt"
+
+// errorsName returns errorsEntry, or if one of entries is already named
+// that, ignoring case as some file systems they are extracted to do, the
+// first of ERRORS-1.txt, ERRORS-2.txt and so on that none is.
+func errorsName(entries []archiveEntry) string {
+	taken := map[string]bool{}
+	for _, e := range entries {
+		// Their directories too, which may not be entries.
+		for p := e.rel; p != "."; p = path.Dir(p) {
+			taken[strings.ToLower(p)] = true
+		}
+	}
+	ext := path.Ext(errorsEntry)
+	name := errorsEntry
+	for i := 1; taken[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(errorsEntry, ext), i, ext)
+	}
+	return name
+}
+
+// How archives take symlinks.
+const (
+	linksStore  = "store"  // as symlinks, if archiveLink may store them
+	linksFollow = "follow" // as what they point to, if it's within the root
+)
+
+// archiveScope is what archives take from the tree.
+type archiveScope struct {
+	// skip leaves out files and directories that can't be read rather
+	// than failing, and lists them in an entry named by errorsName at the
+	// end.
+	skip bool
+	// filesOnly takes regular files only, without directories or
+	// symlinks, as archives did before they had them.
+	filesOnly bool
+	// links is linksStore or linksFollow.
+	links string
+}
+
+// archiveEntries returns what is in or at roots in fsys and sc takes, in
+// the order it is archived, named relative to the directory dirpath they
+// are all in. Other kinds of files, such as devices and pipes, are left
+// out.
+func archiveEntries(fsys FileSystem, dirpath string, roots []string, sc archiveScope) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	var skipped bytes.Buffer
+	var newest time.Time
+	fail := func(p string, err error) error {
+		if !sc.skip {
+			return err
+		}
+		log.Println("archive: skipping", p+":", err)
+		// The path in the error is that on the server.
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		rel := "."
+		if p != dirpath {
+			rel = archiveRel(dirpath, p)
+		}
+		fmt.Fprintf(&skipped, "%s: %v\n", rel, err)
+		return nil
+	}
+
+	var walk func(p string, info fs.FileInfo, err error) error
+	walk = func(p string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && sc.skip {
+			// Find out now, while it can still be left out.
+			var f File
+			if f, err = fsys.Open(p); err == nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			return fail(p, err)
+		}
+		if p == dirpath {
+			// The archive itself.
+			return nil
+		}
+
+		e := archiveEntry{name: p, rel: archiveRel(dirpath, p), info: info}
+		mode := info.Mode()
+		switch {
+		case mode.IsRegular():
+		case sc.filesOnly:
+			return nil
+		case mode.IsDir():
+		case mode&fs.ModeSymlink != 0:
+			target, follow, err := archiveLink(fsys, p, e.rel, sc.links == linksFollow)
+			if err != nil {
+				return fail(p, err)
+			}
+			if follow {
+				return walkFS(fsys, p, walk)
+			}
+			if target == "" {
+				return nil
+			}
+			e.link = target
+		default:
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		entries = append(entries, e)
+		return nil
+	}
+	for _, root := range roots {
+		if err := walkFS(fsys, root, walk); err != nil {
+			return nil, err
+		}
+	}
+	if skipped.Len() > 0 {
+		// As old as the newest file, so archives of the same files come
+		// out the same.
+		name := errorsName(entries)
+		info := dataInfo{name, int64(skipped.Len()), newest}
+		entries = append(entries, archiveEntry{rel: name, info: info, data: skipped.Bytes()})
+	}
+	return entries, nil
+}
+
+// archiveLink returns how to archive the symlink name in fsys, which is rel
+// in the archive: as a link to target, as what it points to if follow, or
+// not at all if neither. Only links whose target is relative and stays
+// within the archive are stored, so archives reveal nothing of the host and
+// can't point outside of where they are extracted. With preferFollow, or
+// for other links, what the link points to is archived instead if it is
+// within the root and not a directory the link is in, which would never
+// end. Only symlinks of a Dir can be read; any other is left out.
+func archiveLink(fsys FileSystem, name, rel string, preferFollow bool) (target string, follow bool, err error) {
+	d, isDir := fsys.(Dir)
+	if !isDir {
+		return "", false, nil
+	}
+	p, err := d.hostPath(name)
+	if err != nil {
+		return "", false, err
+	}
+	if target, err = os.Readlink(p); err != nil {
+		return "", false, err
+	}
+	if !linkWithin(rel, target) {
+		target = ""
+	}
+	if target != "" && !preferFollow {
+		return target, false, nil
+	}
+	if followable(d, name, p) {
+		return "", true, nil
+	}
+	return target, false, nil
+}
+
+// linkWithin reports whether the symlink rel of an archive, pointing to
+// target, points to within the archive by a relative path. It may only go
+// up at its start: what it goes down through may be a symlink itself, so
+// going up after that isn't going up in rel.
+func linkWithin(rel, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+	target = filepath.ToSlash(target)
+	if path.IsAbs(target) {
+		return false
+	}
+	down := false
+	for _, seg := range strings.Split(target, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if down {
+				return false
+			}
+		default:
+			down = true
+		}
+	}
+	p := path.Join(path.Dir(rel), target)
+	return p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// followable reports whether the symlink name of d, at host path p,
+// resolves to within the root of d, and not to a directory name is in.
+func followable(d Dir, name, p string) bool {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	within := func(p, dir string) bool {
+		return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+	}
+	root, err := d.hostPath("/")
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil || !within(real, root) {
+		return false
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		hp, err := d.hostPath(dir)
+		if err == nil {
+			hp, err = filepath.EvalSymlinks(hp)
+		}
+		if err != nil || within(hp, real) {
+			return false
+		}
+		if dir == "/" {
+			return true
+		}
+	}
+}
+
+// dataInfo is the fs.FileInfo of an archiveEntry with data.
+type dataInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (fi dataInfo) Name() string       { return fi.name }
+func (fi dataInfo) Size() int64        { return fi.size }
+func (fi dataInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi dataInfo) ModTime() time.Time { return fi.mtime }
+func (fi dataInfo) IsDir() bool        { return false }
+func (fi dataInfo) Sys() any           { return nil }
+
+// writeArchive writes entries of fsys to aw.
+func writeArchive(aw archiveWriter, fsys FileSystem, entries []archiveEntry) error {
+	for i := range entries {
+		e := &entries[i]
+		if e.data != nil {
+			if err := aw.writeEntry(e, bytes.NewReader(e.data)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.info.Mode().IsRegular() {
+			if err := aw.writeEntry(e, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := fsys.Open(e.name)
+		if err != nil {
+			return err
+		}
+		err = aw.writeEntry(e, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectionForm downloads the entries checked on their listing cards as an
+// archive, with a POST of ?archive=.
+const selectionForm = `
+	  <form id="selection" method="post" action="?archive=zip" class="flex flex-wrap items-center gap-2 my-4 text-sm text-gray-300">
+		<select onchange="this.form.action = '?archive=' + this.value" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white">
+		  <option value="zip">zip</option><option value="tar">tar</option><option value="tar.gz">tar.gz</option><option value="tar.zst">tar.zst</option><option value="tar.xz">tar.xz</option>
+		</select>
+		<button type="submit" disabled class="inline-flex items-center px-3 py-2 font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 disabled:opacity-50">Download selected</button>
+		<span id="selection-count">0 selected</span>
+	  </form>
+	  <script>
+	  document.addEventListener('change', (e) => {
+		if (!e.target.form || e.target.form.id !== 'selection' || e.target.type !== 'checkbox') return;
+		const form = e.target.form;
+		const n = [...form.elements].filter((el) => el.checked).length;
+		form.querySelector('button').disabled = n === 0;
+		document.getElementById('selection-count').textContent = n + ' selected';
+	  });
+	  </script>
+`
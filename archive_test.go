@@ -0,0 +1,412 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// failFS is a FileSystem that fails to open the names in fail.
+type failFS struct {
+	FileSystem
+	fail map[string]error
+}
+
+func (f failFS) Open(name string) (File, error) {
+	if err := f.fail[name]; err != nil {
+		return nil, &fs.PathError{Op: "open", Path: "/srv" + name, Err: err}
+	}
+	return f.FileSystem.Open(name)
+}
+
+// testTree returns a FileSystem of files with the given contents, all
+// modified at the same time.
+func testTree(files map[string]string) FileSystem {
+	m := fstest.MapFS{}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for name, data := range files {
+		m[name] = &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: mtime}
+	}
+	return FS(m)
+}
+
+func TestArchiveErrorsEntry(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		want  string
+	}{
+		{map[string]string{"a.txt": "a", "bad.txt": "b"}, "ERRORS.txt"},
+		{map[string]string{"ERRORS.txt": "mine", "bad.txt": "b"}, "ERRORS-1.txt"},
+		{map[string]string{"errors.txt": "mine", "ERRORS-1.txt": "mine", "bad.txt": "b"}, "ERRORS-2.txt"},
+		{map[string]string{"ERRORS.txt/x": "a dir", "bad.txt": "b"}, "ERRORS-1.txt"},
+	}
+	for _, tt := range tests {
+		fsys := failFS{testTree(tt.files), map[string]error{"/bad.txt": fs.ErrPermission}}
+		entries, err := archiveEntries(fsys, "/", []string{"/"}, archiveScope{skip: true})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.files, err)
+		}
+		last := entries[len(entries)-1]
+		if last.rel != tt.want || last.data == nil {
+			t.Errorf("%v: errors are in %q, want %q", tt.files, last.rel, tt.want)
+		}
+		// Without the path of the file on the server.
+		if got, want := string(last.data), "bad.txt: "+fs.ErrPermission.Error()+"\n"; got != want {
+			t.Errorf("%v: errors are %q, want %q", tt.files, got, want)
+		}
+		for _, e := range entries[:len(entries)-1] {
+			if e.rel == "bad.txt" {
+				t.Errorf("%v: bad.txt archived", tt.files)
+			}
+		}
+	}
+}
+
+func TestErrorsNameIgnoresCase(t *testing.T) {
+	entries := []archiveEntry{{rel: "Errors.TXT"}, {rel: "sub/ERRORS-1.txt"}}
+	if got := errorsName(entries); got != "ERRORS-1.txt" {
+		t.Errorf("got %q, want ERRORS-1.txt", got)
+	}
+	if got := errorsName(nil); got != errorsEntry {
+		t.Errorf("got %q, want %q", got, errorsEntry)
+	}
+	if !strings.HasSuffix(errorsEntry, ".txt") {
+		t.Errorf("errorsEntry %q isn't a text file", errorsEntry)
+	}
+}
+
+func TestArchiveLinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "d/sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for dir, name := range map[string]string{root: "d/sub/f.txt", outside: "x.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"lf":           "d/sub/f.txt",
+		"ld":           "d",
+		"lroot":        ".",
+		"ldang":        "nowhere",
+		"d/sub/lloop":  "../..",
+		"d/sub/lup":    "../../lf",
+		"labs":         filepath.Join(root, "d/sub/f.txt"),
+		"lout":         filepath.Join(outside, "x.txt"),
+		"lesc":         "../" + filepath.Base(outside) + "/x.txt",
+		"d/sub/labsup": filepath.Join(root, "d"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// What each link is archived as: "-> target" if stored, the kinds
+	// of what it points to if followed, or "" if left out.
+	tests := []struct {
+		links   string
+		dirpath string
+		want    map[string]string
+	}{
+		{linksStore, "/", map[string]string{
+			"lf": "-> d/sub/f.txt", "ld": "-> d", "lroot": "-> .", "ldang": "-> nowhere",
+			"d/sub/lloop": "-> ../..", "d/sub/lup": "-> ../../lf",
+			"labs": "file", "lout": "", "lesc": "", "d/sub/labsup": "",
+		}},
+		{linksFollow, "/", map[string]string{
+			"lf": "file", "ld": "dir", "ld/sub/f.txt": "file", "lroot": "-> .", "ldang": "-> nowhere",
+			"d/sub/lloop": "-> ../..", "d/sub/lup": "file",
+			"labs": "file", "lout": "", "lesc": "", "d/sub/labsup": "",
+		}},
+		// Relative to the archived directory, lloop and lup point out of
+		// it, so they are followed if they can be.
+		{linksStore, "/d", map[string]string{
+			"sub/lloop": "", "sub/lup": "file", "sub/labsup": "",
+		}},
+	}
+	for _, tt := range tests {
+		entries, err := archiveEntries(Dir(root), tt.dirpath, []string{tt.dirpath}, archiveScope{links: tt.links})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.links, tt.dirpath, err)
+		}
+		got := map[string]string{}
+		for _, e := range entries {
+			switch {
+			case e.link != "":
+				got[e.rel] = "-> " + e.link
+			case e.info.IsDir():
+				got[e.rel] = "dir"
+			case e.info.Mode().IsRegular():
+				got[e.rel] = "file"
+			default:
+				got[e.rel] = e.info.Mode().String()
+			}
+		}
+		for rel, want := range tt.want {
+			if got[rel] != want {
+				t.Errorf("%s %s: %s is %q, want %q", tt.links, tt.dirpath, rel, got[rel], want)
+			}
+		}
+	}
+}
+
+func TestLinkWithin(t *testing.T) {
+	tests := []struct {
+		rel, target string
+		want        bool
+	}{
+		{"a", "b", true},
+		{"a", ".", true},
+		{"a/b", "../c", true},
+		{"a/b", "../../c", false},
+		{"a", "..", false},
+		{"a", "/etc/passwd", false},
+		{"a", "", false},
+		{"a/b/c", "../../x", true},
+		{"a/b/c", "../../../x", false},
+		{"a/b/c", "./../x", true},
+		// d may be a link to anywhere within.
+		{"a/b/c", "d/../x", false},
+	}
+	for _, tt := range tests {
+		if got := linkWithin(tt.rel, tt.target); got != tt.want {
+			t.Errorf("linkWithin(%q, %q) = %v, want %v", tt.rel, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveSelection(t *testing.T) {
+	fsys := testTree(map[string]string{
+		"d/a.txt":   "a",
+		"d/sub/b":   "b",
+		"d/sub/c":   "c",
+		"d/e f.txt": "e",
+		"top.txt":   "t",
+	})
+	tests := []struct {
+		paths []string
+		want  []string // nil for errBadSelection
+	}{
+		{[]string{"a.txt"}, []string{"/d/a.txt"}},
+		{[]string{"sub/c", "a.txt", "sub/b"}, []string{"/d/a.txt", "/d/sub/b", "/d/sub/c"}},
+		{[]string{"a.txt", "./a.txt", "sub/../a.txt"}, []string{"/d/a.txt"}},
+		{[]string{"sub/b", "sub", "sub/c"}, []string{"/d/sub"}},
+		{[]string{"sub/", "e f.txt"}, []string{"/d/e f.txt", "/d/sub"}},
+		{nil, nil},
+		{[]string{""}, nil},
+		{[]string{"."}, nil},
+		{[]string{".."}, nil},
+		{[]string{"../top.txt"}, nil},
+		{[]string{"sub/../../top.txt"}, nil},
+		{[]string{"/top.txt"}, nil},
+		{[]string{"a.txt", "/d/a.txt"}, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/d/?archive=zip", strings.NewReader(url.Values{"path": tt.paths}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		got, err := archiveSelection(fsys, "/d", r, false)
+		if tt.want == nil {
+			if !errors.Is(err, errBadSelection) {
+				t.Errorf("%q: got %q, %v, want %v", tt.paths, got, err, errBadSelection)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %q, %v, want %q", tt.paths, got, err, tt.want)
+		}
+	}
+}
+
+func TestArchiveSelectionMissing(t *testing.T) {
+	fsys := failFS{testTree(map[string]string{"a": "a", "locked": "l"}), map[string]error{"/locked": fs.ErrPermission}}
+	for _, tt := range []struct {
+		path string
+		skip bool
+		ok   bool
+	}{
+		{"gone", false, false},
+		{"gone", true, false},
+		{"locked", false, false},
+		// Left to archiveEntries to list in the errors entry.
+		{"locked", true, true},
+	} {
+		r := httptest.NewRequest("POST", "/?archive=tar", strings.NewReader("path="+tt.path))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err := archiveSelection(fsys, "/", r, tt.skip)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s with skip %v: got %v", tt.path, tt.skip, err)
+		}
+		if err != nil && errors.Is(err, errBadSelection) {
+			t.Errorf("%s with skip %v: %v is not a bad selection", tt.path, tt.skip, err)
+		}
+	}
+}
+
+// archiveFiles returns the names of what the archive in format holds, with
+// a slash after directories, and the contents of its regular files.
+func archiveFiles(t *testing.T, format string, b []byte) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", f.Name, err)
+			}
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+
+	var r io.Reader = bytes.NewReader(b)
+	var err error
+	switch format {
+	case "tar.gz":
+		r, err = gzip.NewReader(r)
+	case "tar.zst":
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(r)
+		if err == nil {
+			defer zr.Close()
+		}
+		r = zr
+	case "tar.xz":
+		r, err = xz.NewReader(r)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%s: %v", h.Name, err)
+		}
+		files[h.Name] = string(data)
+	}
+	return files
+}
+
+func TestArchiveFormats(t *testing.T) {
+	tree := map[string]string{
+		"a.txt":           strings.Repeat("compressible ", 1000),
+		"photo.jpg":       "\xff\xd8\xff not really",
+		"sub/deep/z.txt":  "z",
+		"sub/ünïcödé.txt": "u",
+		"sub/empty":       "",
+		strings.Repeat("x", 120) + "/" + strings.Repeat("y", 120): "long",
+	}
+	fsys := testTree(tree)
+	entries, err := archiveEntries(fsys, "/", []string{"/"}, archiveScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for name, data := range tree {
+		want[name] = data
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			want[d+"/"] = ""
+		}
+	}
+
+	for format, f := range archiveFormats {
+		levels := []int{-1}
+		for level := f.minLevel; level <= f.maxLevel; level += max(f.maxLevel/2, 1) {
+			levels = append(levels, level)
+		}
+		for _, level := range levels {
+			var buf bytes.Buffer
+			aw, err := newArchiveWriter(&buf, format, level, typeList{"image/*"})
+			if err != nil {
+				t.Fatalf("%s level %d: %v", format, level, err)
+			}
+			if err := writeArchive(aw, fsys, entries); err != nil {
+				t.Fatalf("%s level %d: %v", format, level, err)
+			}
+			if err := aw.Close(); err != nil {
+				t.Fatalf("%s level %d: %v", format, level, err)
+			}
+			if got := archiveFiles(t, format, buf.Bytes()); !maps.Equal(got, want) {
+				t.Errorf("%s level %d: got %q, want %q", format, level, got, want)
+			}
+
+			if format != "zip" {
+				continue
+			}
+			zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			for _, zf := range zr.File {
+				stored := level == 0 || zf.Name == "photo.jpg" || strings.HasSuffix(zf.Name, "/")
+				if stored != (zf.Method == zip.Store) {
+					t.Errorf("zip level %d: %s has method %d", level, zf.Name, zf.Method)
+				}
+			}
+		}
+	}
+}
+
+func TestArchiveLevels(t *testing.T) {
+	fh := &fileHandler{root: testTree(map[string]string{"a.txt": "a"}), archiveZstdMax: 9}
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"archive=tar", 200},
+		{"archive=tar&level=1", 400},
+		{"archive=tar.gz&level=9", 200},
+		{"archive=tar.gz&level=10", 400},
+		{"archive=tar.gz&level=-1", 400},
+		{"archive=tar.gz&level=x", 400},
+		{"archive=tar.zst&level=0", 400},
+		{"archive=tar.zst&level=1", 200},
+		{"archive=tar.zst&level=9", 200},
+		{"archive=tar.zst&level=10", 400},
+		{"archive=tar.xz&level=7", 200},
+		{"archive=tar.xz&level=8", 400},
+		{"archive=zip&level=0", 200},
+		{"archive=rar", 400},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, httptest.NewRequest("GET", "/?"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d: %s", tt.query, w.Code, tt.code, w.Body)
+		}
+	}
+}
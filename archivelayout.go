@@ -0,0 +1,598 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// archiveLayout is an archive whose every byte is known before it's sent,
+// or can be worked out from the files in it: a plain tar, or a zip that
+// stores all its files. So it has a size, and can be read from anywhere,
+// for Range requests that resume downloads.
+type archiveLayout struct {
+	fsys  FileSystem
+	crcs  *crcCache
+	parts []archivePart
+	size  int64
+	// etag is derived from the format and the names, sizes, modes,
+	// mtimes and link targets of the entries, which make up the whole
+	// archive.
+	etag string
+}
+
+// archivePart is a run of bytes of an archiveLayout, which are data, the
+// contents of the file entry, or what gen returns, as zip records holding
+// CRCs of files do.
+type archivePart struct {
+	off   int64
+	size  int64
+	data  []byte
+	entry *archiveEntry
+	gen   func() ([]byte, error)
+}
+
+func (l *archiveLayout) add(p archivePart) {
+	if p.data != nil {
+		p.size = int64(len(p.data))
+	}
+	if p.entry != nil {
+		p.size = p.entry.info.Size()
+	}
+	p.off = l.size
+	l.size += p.size
+	l.parts = append(l.parts, p)
+}
+
+// addContents adds the contents of the file e, or in zips the target of
+// the symlink e.
+func (l *archiveLayout) addContents(e *archiveEntry) {
+	switch {
+	case e.data != nil:
+		l.add(archivePart{data: e.data})
+	case e.link != "":
+		l.add(archivePart{data: []byte(e.link)})
+	default:
+		l.add(archivePart{entry: e})
+	}
+}
+
+// newArchiveLayout returns the layout of the archive of entries of fsys in
+// format, compressed at level, or nil if it's compressed. Zips store the
+// types store lists even so, and are laid out if that is all of them.
+func newArchiveLayout(fsys FileSystem, crcs *crcCache, format string, level int, store typeList, entries []archiveEntry) (*archiveLayout, error) {
+	switch format {
+	case "tar":
+	case "zip":
+		for i := range entries {
+			if !zipStores(level, store, &entries[i]) {
+				return nil, nil
+			}
+		}
+	default:
+		return nil, nil
+	}
+
+	l := &archiveLayout{fsys: fsys, crcs: crcs}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\n", format)
+	for _, e := range entries {
+		fmt.Fprintf(sum, "%q %d %o %d %q\n", e.rel, e.info.Size(), e.info.Mode(), e.info.ModTime().UnixNano(), e.link)
+		sum.Write(e.data)
+	}
+	l.etag = `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+
+	if format == "tar" {
+		return l, l.addTar(entries)
+	}
+	l.addZip(entries)
+	return l, nil
+}
+
+// addTar lays out a tar of entries, as tarArchive writes it.
+func (l *archiveLayout) addTar(entries []archiveEntry) error {
+	for i := range entries {
+		e := &entries[i]
+		h, err := tarHeader(e)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(h); err != nil {
+			return err
+		}
+		l.add(archivePart{data: buf.Bytes()})
+		if !e.info.Mode().IsRegular() {
+			continue
+		}
+		l.addContents(e)
+		if pad := -e.info.Size() & (tarBlock - 1); pad > 0 {
+			l.add(archivePart{data: make([]byte, pad)})
+		}
+	}
+	// Two zero blocks end a tar.
+	l.add(archivePart{data: make([]byte, 2*tarBlock)})
+	return nil
+}
+
+const tarBlock = 512
+
+// ZIP format constants, as archive/zip has them.
+const (
+	zipLocalSig      = 0x04034b50
+	zipCentralSig    = 0x02014b50
+	zipDescriptorSig = 0x08074b50
+	zipEndSig        = 0x06054b50
+	zip64EndSig      = 0x06064b50
+	zip64LocatorSig  = 0x07064b50
+	zip64ExtraID     = 0x0001
+	zipExtTimeID     = 0x5455
+	zipVersion20     = 20
+	zipVersion45     = 45
+	zipCreatorUnix   = 3
+	zipMax32         = 1<<32 - 1
+	zipMax16         = 1<<16 - 1
+)
+
+// zipRecord is what the records of a stored file in a zip are made of.
+type zipRecord struct {
+	entry  *archiveEntry
+	offset int64 // of its local header
+}
+
+// size is the size of the contents of the entry: none for directories,
+// and the target for symlinks.
+func (z zipRecord) size() int64 {
+	switch {
+	case z.entry.info.IsDir():
+		return 0
+	case z.entry.link != "":
+		return int64(len(z.entry.link))
+	}
+	return z.entry.info.Size()
+}
+
+func (z zipRecord) zip64() bool {
+	return z.size() >= zipMax32
+}
+
+// name is the name of the entry, which ends in a slash for directories.
+func (z zipRecord) name() string {
+	if z.entry.info.IsDir() {
+		return z.entry.rel + "/"
+	}
+	return z.entry.rel
+}
+
+// flags are data descriptor after the data, except for directories which
+// have none, and UTF-8 names if needed, by the rules of archive/zip: for
+// valid UTF-8 beyond what most encodings have in common with ASCII.
+func (z zipRecord) flags() uint16 {
+	var flags uint16 = 0x8
+	if z.entry.info.IsDir() {
+		flags = 0
+	}
+	name := z.name()
+	if !utf8.ValidString(name) {
+		return flags
+	}
+	for _, r := range name {
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			return flags | 0x800
+		}
+	}
+	return flags
+}
+
+// dosTime returns the MS-DOS date and time of the file.
+func (z zipRecord) dosTime() (date, tim uint16) {
+	t := zipModTime(z.entry.info)
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tim = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tim
+}
+
+// extTime returns the extended timestamp extra field of the file, which
+// has its mtime in full seconds.
+func (z zipRecord) extTime() []byte {
+	b := binary.LittleEndian.AppendUint16(nil, zipExtTimeID)
+	b = binary.LittleEndian.AppendUint16(b, 5)
+	b = append(b, 1)
+	return binary.LittleEndian.AppendUint32(b, uint32(zipModTime(z.entry.info).Unix()))
+}
+
+// local returns the local file header. Its CRC and sizes are in the data
+// descriptor, so it can be written before the file is read.
+func (z zipRecord) local() []byte {
+	date, tim := z.dosTime()
+	extra := z.extTime()
+	b := binary.LittleEndian.AppendUint32(nil, zipLocalSig)
+	b = binary.LittleEndian.AppendUint16(b, zipVersion20)
+	b = binary.LittleEndian.AppendUint16(b, z.flags())
+	b = binary.LittleEndian.AppendUint16(b, 0) // stored
+	b = binary.LittleEndian.AppendUint16(b, tim)
+	b = binary.LittleEndian.AppendUint16(b, date)
+	b = binary.LittleEndian.AppendUint32(b, 0) // CRC
+	b = binary.LittleEndian.AppendUint32(b, 0) // compressed size
+	b = binary.LittleEndian.AppendUint32(b, 0) // uncompressed size
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(z.name())))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+	b = append(b, z.name()...)
+	return append(b, extra...)
+}
+
+// descriptorSize is the size of the data descriptor.
+func (z zipRecord) descriptorSize() int64 {
+	if z.zip64() {
+		return 24
+	}
+	return 16
+}
+
+// descriptor returns the data descriptor following the file, whose CRC
+// is crc.
+func (z zipRecord) descriptor(crc uint32) []byte {
+	size := z.size()
+	b := binary.LittleEndian.AppendUint32(nil, zipDescriptorSig)
+	b = binary.LittleEndian.AppendUint32(b, crc)
+	if z.zip64() {
+		b = binary.LittleEndian.AppendUint64(b, uint64(size))
+		return binary.LittleEndian.AppendUint64(b, uint64(size))
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	return binary.LittleEndian.AppendUint32(b, uint32(size))
+}
+
+// central returns the central directory header of the file, whose CRC is
+// crc. Its size doesn't depend on crc.
+func (z zipRecord) central(crc uint32) []byte {
+	size := z.size()
+	date, tim := z.dosTime()
+	extra := z.extTime()
+	version := uint16(zipVersion20)
+	size32 := uint32(size)
+	if z.zip64() || z.offset >= zipMax32 {
+		version = zipVersion45
+		size32 = zipMax32
+		extra = binary.LittleEndian.AppendUint16(extra, zip64ExtraID)
+		extra = binary.LittleEndian.AppendUint16(extra, 24)
+		extra = binary.LittleEndian.AppendUint64(extra, uint64(size))
+		extra = binary.LittleEndian.AppendUint64(extra, uint64(size))
+		extra = binary.LittleEndian.AppendUint64(extra, uint64(z.offset))
+	}
+	attrs := zipAttrs(z.entry.info.Mode())
+
+	b := binary.LittleEndian.AppendUint32(nil, zipCentralSig)
+	b = binary.LittleEndian.AppendUint16(b, zipCreatorUnix<<8|version)
+	b = binary.LittleEndian.AppendUint16(b, version)
+	b = binary.LittleEndian.AppendUint16(b, z.flags())
+	b = binary.LittleEndian.AppendUint16(b, 0) // stored
+	b = binary.LittleEndian.AppendUint16(b, tim)
+	b = binary.LittleEndian.AppendUint16(b, date)
+	b = binary.LittleEndian.AppendUint32(b, crc)
+	b = binary.LittleEndian.AppendUint32(b, size32)
+	b = binary.LittleEndian.AppendUint32(b, size32)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(z.name())))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+	b = binary.LittleEndian.AppendUint16(b, 0) // comment length
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk number
+	b = binary.LittleEndian.AppendUint16(b, 0) // internal attributes
+	b = binary.LittleEndian.AppendUint32(b, attrs)
+	b = binary.LittleEndian.AppendUint32(b, uint32(min(z.offset, zipMax32)))
+	b = append(b, z.name()...)
+	return append(b, extra...)
+}
+
+// zipAttrs returns the external attributes of a file with mode: its Unix
+// mode, and the MS-DOS directory and read-only bits, as archive/zip sets
+// them.
+func zipAttrs(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		m |= 0o040000
+	case mode&fs.ModeSymlink != 0:
+		m |= 0o120000
+	default:
+		m |= 0o100000
+	}
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	attrs := m << 16
+	if mode.IsDir() {
+		attrs |= 0x10
+	}
+	if mode&0o200 == 0 {
+		attrs |= 0x01
+	}
+	return attrs
+}
+
+// addZip lays out a zip storing entries. Its records are those of
+// archive/zip, which zipArchive writes.
+func (l *archiveLayout) addZip(entries []archiveEntry) {
+	records := make([]zipRecord, len(entries))
+	for i := range entries {
+		z := zipRecord{entry: &entries[i], offset: l.size}
+		records[i] = z
+		l.add(archivePart{data: z.local()})
+		if z.entry.info.IsDir() {
+			continue
+		}
+		l.addContents(z.entry)
+		l.add(archivePart{size: z.descriptorSize(), gen: func() ([]byte, error) {
+			crc, err := l.crc(z.entry)
+			return z.descriptor(crc), err
+		}})
+	}
+
+	start := l.size
+	var size int64
+	for _, z := range records {
+		size += int64(len(z.central(0)))
+	}
+	l.add(archivePart{size: size, gen: func() ([]byte, error) {
+		var b []byte
+		for _, z := range records {
+			crc, err := l.crc(z.entry)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, z.central(crc)...)
+		}
+		return b, nil
+	}})
+
+	var b []byte
+	n := len(records)
+	if n >= zipMax16 || size >= zipMax32 || start >= zipMax32 {
+		end64 := l.size
+		b = binary.LittleEndian.AppendUint32(b, zip64EndSig)
+		b = binary.LittleEndian.AppendUint64(b, 44) // size of the rest of the record
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)
+		b = binary.LittleEndian.AppendUint32(b, 0) // disk number
+		b = binary.LittleEndian.AppendUint32(b, 0) // disk of the central directory
+		b = binary.LittleEndian.AppendUint64(b, uint64(n))
+		b = binary.LittleEndian.AppendUint64(b, uint64(n))
+		b = binary.LittleEndian.AppendUint64(b, uint64(size))
+		b = binary.LittleEndian.AppendUint64(b, uint64(start))
+
+		b = binary.LittleEndian.AppendUint32(b, zip64LocatorSig)
+		b = binary.LittleEndian.AppendUint32(b, 0) // disk of the zip64 end
+		b = binary.LittleEndian.AppendUint64(b, uint64(end64))
+		b = binary.LittleEndian.AppendUint32(b, 1) // total disks
+
+		n, size, start = zipMax16, zipMax32, zipMax32
+	}
+	b = binary.LittleEndian.AppendUint32(b, zipEndSig)
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk number
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk of the central directory
+	b = binary.LittleEndian.AppendUint16(b, uint16(n))
+	b = binary.LittleEndian.AppendUint16(b, uint16(n))
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = binary.LittleEndian.AppendUint32(b, uint32(start))
+	b = binary.LittleEndian.AppendUint16(b, 0) // comment length
+	l.add(archivePart{data: b})
+}
+
+// crc returns the CRC-32 of the file e, reading it unless it is cached.
+func (l *archiveLayout) crc(e *archiveEntry) (uint32, error) {
+	switch {
+	case e.info.IsDir():
+		return 0, nil
+	case e.data != nil:
+		return crc32.ChecksumIEEE(e.data), nil
+	case e.link != "":
+		return crc32.ChecksumIEEE([]byte(e.link)), nil
+	}
+	key := crcKey(e)
+	if crc, ok := l.crcs.get(key); ok {
+		return crc, nil
+	}
+	f, err := l.fsys.Open(e.name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, io.LimitReader(f, e.info.Size()))
+	if err == nil && n != e.info.Size() {
+		err = fmt.Errorf("mismatch of size with %s", e.rel)
+	}
+	if err != nil {
+		return 0, err
+	}
+	l.crcs.put(key, h.Sum32())
+	return h.Sum32(), nil
+}
+
+// reader returns a reader of the archive, which must be closed.
+func (l *archiveLayout) reader() *layoutReader {
+	return &layoutReader{l: l, gens: map[int][]byte{}}
+}
+
+// layoutReader reads an archiveLayout. It works out the CRCs of the files
+// it reads whole on the way, so that zips only need to read them again for
+// what they skip.
+type layoutReader struct {
+	l    *archiveLayout
+	pos  int64
+	gens map[int][]byte
+	// err is the first error reading failed with.
+	err error
+
+	// f is open on the file of part fpart, at fpos, and crc has what
+	// was read of it if that was all from its start.
+	f     File
+	fpart int
+	fpos  int64
+	crc   hash.Hash32
+}
+
+func (r *layoutReader) Read(p []byte) (int, error) {
+	n, err := r.read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *layoutReader) read(p []byte) (int, error) {
+	if r.pos >= r.l.size {
+		return 0, io.EOF
+	}
+	parts := r.l.parts
+	i := sort.Search(len(parts), func(i int) bool { return parts[i].off+parts[i].size > r.pos })
+	part := &parts[i]
+	off := r.pos - part.off
+	if rest := part.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	var n int
+	var err error
+	switch {
+	case part.entry != nil:
+		n, err = r.readFile(i, off, p)
+	case part.gen != nil:
+		data, ok := r.gens[i]
+		if !ok {
+			if data, err = part.gen(); err != nil {
+				return 0, err
+			}
+			r.gens[i] = data
+		}
+		n = copy(p, data[off:])
+	default:
+		n = copy(p, part.data[off:])
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+// readFile reads p from the file of part i, from off in it.
+func (r *layoutReader) readFile(i int, off int64, p []byte) (int, error) {
+	e := r.l.parts[i].entry
+	if r.f == nil || r.fpart != i || r.fpos != off {
+		r.closeFile()
+		f, err := r.l.fsys.Open(e.name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			f.Close()
+			return 0, err
+		}
+		r.f, r.fpart, r.fpos, r.crc = f, i, off, nil
+		if off == 0 {
+			r.crc = crc32.NewIEEE()
+		}
+	}
+
+	n, err := r.f.Read(p)
+	if r.crc != nil {
+		r.crc.Write(p[:n])
+	}
+	r.fpos += int64(n)
+	if err == io.EOF {
+		err = nil
+		if n == 0 {
+			err = fmt.Errorf("mismatch of size with %s", e.rel)
+		}
+	}
+	if r.fpos == e.info.Size() {
+		if r.crc != nil {
+			r.l.crcs.put(crcKey(e), r.crc.Sum32())
+		}
+		r.closeFile()
+	}
+	return n, err
+}
+
+func (r *layoutReader) closeFile() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+func (r *layoutReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.l.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *layoutReader) Close() error {
+	r.closeFile()
+	return nil
+}
+
+// crcCacheMax is how many CRCs a crcCache holds before it starts over.
+const crcCacheMax = 1 << 16
+
+// crcCache remembers the CRC-32 of files read for zips, so the central
+// directory of one resumed with a Range request doesn't need to read all
+// that was sent before again. A nil crcCache remembers nothing.
+type crcCache struct {
+	mu   sync.Mutex
+	crcs map[string]uint32
+}
+
+func newCRCCache() *crcCache {
+	return &crcCache{crcs: map[string]uint32{}}
+}
+
+// crcKey identifies the contents of the file e by its name, size and mtime.
+func crcKey(e *archiveEntry) string {
+	return e.name + "\x00" + strconv.FormatInt(e.info.Size(), 10) + "\x00" + strconv.FormatInt(e.info.ModTime().UnixNano(), 10)
+}
+
+func (c *crcCache) get(key string) (uint32, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	crc, ok := c.crcs[key]
+	return crc, ok
+}
+
+func (c *crcCache) put(key string, crc uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.crcs) >= crcCacheMax {
+		c.crcs = map[string]uint32{}
+	}
+	c.crcs[key] = crc
+}
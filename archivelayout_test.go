@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writtenArchive returns the archive of entries of fsys in format, as
+// newArchiveWriter writes it.
+func writtenArchive(t *testing.T, fsys FileSystem, format string, level int, store typeList, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	aw, err := newArchiveWriter(&buf, format, level, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchive(aw, fsys, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// layoutTrees returns trees to lay out archives of: with names that need
+// UTF-8 and some that don't, mtimes in another zone than UTC and before
+// 1980, which MS-DOS times can't hold, symlinks, and an errors entry.
+func layoutTrees(t *testing.T) map[string]struct {
+	fsys  FileSystem
+	scope archiveScope
+} {
+	t.Helper()
+	zone := time.FixedZone("UTC+5:30", 5*3600+1800)
+	m := fstest.MapFS{}
+	for name, data := range map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "see",
+		"b/d/e.bin":   string(bytes.Repeat([]byte{0, 1, 2, 3}, 1000)),
+		"empty":       "",
+		"ünï.txt":     "u",
+		"tilde~.txt":  "t",
+		"back\\slash": "b",
+		"bad.txt":     "unreadable",
+	} {
+		m[name] = &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: time.Date(2001, 2, 3, 23, 59, 58, 0, zone)}
+	}
+	m["b/d"] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC)}
+	m["ro.txt"] = &fstest.MapFile{Data: []byte("ro"), Mode: 0o444, ModTime: time.Unix(1e9, 0)}
+
+	root := t.TempDir()
+	for _, name := range []string{"d/f.txt", "g.txt"} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{"ld": "d", "d/lg": "../g.txt", "dangling": "nowhere"} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return map[string]struct {
+		fsys  FileSystem
+		scope archiveScope
+	}{
+		"fs":    {failFS{FS(m), map[string]error{"/bad.txt": fs.ErrPermission}}, archiveScope{skip: true}},
+		"dir":   {Dir(root), archiveScope{links: linksStore}},
+		"files": {Dir(root), archiveScope{filesOnly: true}},
+	}
+}
+
+// readLayout reads all of l.
+func readLayout(t *testing.T, l *archiveLayout) []byte {
+	t.Helper()
+	lr := l.reader()
+	defer lr.Close()
+	b, err := io.ReadAll(lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(b)) != l.size {
+		t.Fatalf("read %d bytes of a layout of %d", len(b), l.size)
+	}
+	return b
+}
+
+func TestArchiveLayoutMatchesWriter(t *testing.T) {
+	for tree, tt := range layoutTrees(t) {
+		entries, err := archiveEntries(tt.fsys, "/", []string{"/"}, tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{"tar", "zip"} {
+			l, err := newArchiveLayout(tt.fsys, newCRCCache(), format, 0, nil, entries)
+			if err != nil || l == nil {
+				t.Fatalf("%s %s: layout %v, %v", tree, format, l, err)
+			}
+			got := readLayout(t, l)
+			want := writtenArchive(t, tt.fsys, format, 0, nil, entries)
+			if !bytes.Equal(got, want) {
+				i := 0
+				for i < min(len(got), len(want)) && got[i] == want[i] {
+					i++
+				}
+				t.Errorf("%s %s: layout differs from the writer at %d of %d/%d:\n%q\n%q", tree, format, i, len(got), len(want),
+					got[max(i-16, 0):min(i+32, len(got))], want[max(i-16, 0):min(i+32, len(want))])
+			}
+		}
+	}
+}
+
+func TestArchiveLayoutOnlyUncompressed(t *testing.T) {
+	fsys := testTree(map[string]string{"a.txt": "a", "b.jpg": "b"})
+	entries, err := archiveEntries(fsys, "/", []string{"/"}, archiveScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		format string
+		level  int
+		store  typeList
+		laid   bool
+	}{
+		{"tar", -1, nil, true},
+		{"zip", 0, nil, true},
+		{"zip", -1, typeList{"*"}, true},
+		{"zip", -1, typeList{"image/*"}, false},
+		{"zip", 9, typeList{".txt", ".jpg"}, true},
+		{"tar.gz", 0, nil, false},
+		{"tar.zst", -1, nil, false},
+		{"tar.xz", -1, nil, false},
+	}
+	for _, tt := range tests {
+		l, err := newArchiveLayout(fsys, nil, tt.format, tt.level, tt.store, entries)
+		if err != nil || (l != nil) != tt.laid {
+			t.Errorf("%s level %d store %q: got %v, %v", tt.format, tt.level, tt.store, l, err)
+		}
+	}
+}
+
+func TestLayoutReaderSeek(t *testing.T) {
+	for tree, tt := range layoutTrees(t) {
+		entries, err := archiveEntries(tt.fsys, "/", []string{"/"}, tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{"tar", "zip"} {
+			l, err := newArchiveLayout(tt.fsys, newCRCCache(), format, 0, nil, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			whole := readLayout(t, l)
+
+			// Every part boundary and either side of it, and then
+			// some, read by fresh readers, which must work out the
+			// CRCs of files they skip, and by one seeking back and
+			// forth.
+			var offs []int64
+			for _, p := range l.parts {
+				offs = append(offs, p.off-1, p.off, p.off+1, p.off+p.size/2)
+			}
+			rnd := rand.New(rand.NewPCG(1, 2))
+			for range 50 {
+				offs = append(offs, rnd.Int64N(l.size))
+			}
+			shared := l.reader()
+			for _, off := range offs {
+				if off < 0 || off >= l.size {
+					continue
+				}
+				for _, n := range []int64{1, 7, 600, l.size} {
+					want := whole[off:min(off+n, l.size)]
+					fresh := &archiveLayout{fsys: l.fsys, crcs: newCRCCache(), parts: l.parts, size: l.size}
+					for _, r := range []*layoutReader{fresh.reader(), shared} {
+						if _, err := r.Seek(off, io.SeekStart); err != nil {
+							t.Fatal(err)
+						}
+						got := make([]byte, len(want))
+						if _, err := io.ReadFull(r, got); err != nil {
+							t.Fatalf("%s %s: reading %d at %d: %v", tree, format, n, off, err)
+						}
+						if !bytes.Equal(got, want) {
+							t.Fatalf("%s %s: %d at %d differ", tree, format, n, off)
+						}
+					}
+				}
+			}
+			shared.Close()
+
+			if _, err := shared.Seek(-1, io.SeekStart); err == nil {
+				t.Errorf("seeking before the start")
+			}
+			if n, err := shared.Seek(-2, io.SeekEnd); n != l.size-2 || err != nil {
+				t.Errorf("seeking from the end: %d, %v", n, err)
+			}
+			if n, err := shared.Read(make([]byte, 10)); n != 2 || err != nil {
+				t.Errorf("reading the end: %d, %v", n, err)
+			}
+			if n, err := shared.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+				t.Errorf("reading past the end: %d, %v", n, err)
+			}
+		}
+	}
+}
+
+func TestServeArchiveRange(t *testing.T) {
+	tree := layoutTrees(t)["dir"]
+	fh := &fileHandler{root: tree.fsys, archiveScope: tree.scope, archiveCRCs: newCRCCache()}
+	for format, level := range map[string]string{"tar": "", "zip": "&level=0"} {
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, httptest.NewRequest("GET", "/?archive="+format+level, nil))
+		whole, etag := w.Body.Bytes(), w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" || w.Header().Get("Content-Length") != strconv.Itoa(len(whole)) {
+			t.Fatalf("%s: got %d, ETag %q, Content-Length %q of %d bytes", format, w.Code, etag, w.Header().Get("Content-Length"), len(whole))
+		}
+
+		for _, rng := range [][2]int{{0, 0}, {1, 100}, {len(whole) / 2, len(whole)*2/3 - 1}, {len(whole) - 30, len(whole) - 1}} {
+			r := httptest.NewRequest("GET", "/?archive="+format+level, nil)
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]))
+			r.Header.Set("If-Range", etag)
+			w := httptest.NewRecorder()
+			fh.ServeHTTP(w, r)
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), whole[rng[0]:rng[1]+1]) {
+				t.Errorf("%s: range %v: got %d, %d bytes", format, rng, w.Code, w.Body.Len())
+			}
+		}
+
+		r := httptest.NewRequest("GET", "/?archive="+format+level, nil)
+		r.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		fh.ServeHTTP(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s: If-None-Match: got %d", format, w.Code)
+		}
+	}
+}
+
+// readerAt reads a layoutReader at offsets, for zip.NewReader.
+type readerAt struct{ r *layoutReader }
+
+func (ra readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := ra.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(ra.r, p)
+}
+
+// zeroFS is a FileSystem of files of zeros of the sizes in it.
+type zeroFS map[string]int64
+
+func (z zeroFS) Open(name string) (File, error) {
+	size, ok := z[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &zeroFile{name: name, size: size}, nil
+}
+
+type zeroFile struct {
+	name      string
+	size, pos int64
+}
+
+func (f *zeroFile) Close() error { return nil }
+
+func (f *zeroFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), f.size-f.pos))
+	clear(p[:n])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *zeroFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("unsupported whence")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *zeroFile) Readdir(int) ([]fs.FileInfo, error) { return nil, errors.New("not a directory") }
+
+func (f *zeroFile) Stat() (fs.FileInfo, error) {
+	return dataInfo{path.Base(f.name), f.size, time.Time{}}, nil
+}
+
+func TestArchiveLayoutZip64(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := zeroFS{"/big": 5 << 30, "/small": 5}
+	crcs := newCRCCache()
+	tests := map[string][]archiveEntry{
+		"large file": {
+			{name: "/big", rel: "big", info: dataInfo{"big", fsys["/big"], mtime}},
+			{name: "/small", rel: "small", info: dataInfo{"small", fsys["/small"], mtime}},
+		},
+	}
+	// Its CRC isn't checked, as only the end of the zip is read.
+	crcs.put(crcKey(&tests["large file"][0]), 0)
+	many := make([]archiveEntry, zipMax16+1)
+	for i := range many {
+		name := fmt.Sprintf("f%05d", i)
+		many[i] = archiveEntry{rel: name, info: dataInfo{name, 1, mtime}, data: []byte{byte(i)}}
+	}
+	tests["many files"] = many
+
+	for name, entries := range tests {
+		l, err := newArchiveLayout(fsys, crcs, "zip", 0, nil, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lr := l.reader()
+		zr, err := zip.NewReader(readerAt{lr}, l.size)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(zr.File) != len(entries) {
+			t.Fatalf("%s: %d files, want %d", name, len(zr.File), len(entries))
+		}
+		for i, f := range zr.File {
+			e := &entries[i]
+			if f.Name != e.rel || f.UncompressedSize64 != uint64(e.info.Size()) || !f.Modified.Equal(mtime) {
+				t.Fatalf("%s: file %d is %s of %d, want %s of %d", name, i, f.Name, f.UncompressedSize64, e.rel, e.info.Size())
+			}
+		}
+		// The local header of the last file is found past the first.
+		last := zr.File[len(zr.File)-1]
+		rc, err := last.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if want := entries[len(entries)-1]; err != nil || int64(len(data)) != want.info.Size() {
+			t.Errorf("%s: reading %s: %q, %v", name, last.Name, data, err)
+		}
+		lr.Close()
+	}
+}
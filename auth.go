@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authHandler guards next with HTTP Basic auth backed by an htpasswd file
+// and/or static bearer tokens. Tokens may also come in a ?token= query
+// parameter, for players and other programs that can only be given a URL.
+// With guest set, requests that only read are let through without
+// credentials.
+type authHandler struct {
+	next   http.Handler
+	users  map[string]string // user -> htpasswd hash
+	tokens []string
+	guest  bool
+}
+
+// newAuthHandler wraps next with authentication. An empty htpasswd or
+// tokens path disables that method; if both are empty, next is returned
+// as is.
+func newAuthHandler(next http.Handler, htpasswd, tokens string, guest bool) (http.Handler, error) {
+	if htpasswd == "" && tokens == "" {
+		return next, nil
+	}
+	a := &authHandler{next: next, guest: guest}
+	if htpasswd != "" {
+		users, err := readHtpasswd(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+	if tokens != "" {
+		list, err := readTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = list
+	}
+	return a, nil
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.authorized(r) || (a.guest && isReadRequest(r)) {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	if a.users != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="browsile", charset="UTF-8"`)
+	}
+	if a.tokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="browsile"`)
+	}
+	http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+}
+
+// authorized reports whether r carries valid credentials.
+func (a *authHandler) authorized(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok && a.users != nil {
+		hash, ok := a.users[user]
+		return ok && checkHtpasswd(hash, pass)
+	}
+	if token := requestToken(r); token != "" {
+		return a.validToken(token)
+	}
+	return false
+}
+
+// requestToken returns the bearer token of r, from its Authorization
+// header or its token query parameter, or "".
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (a *authHandler) validToken(token string) bool {
+	valid := false
+	for _, t := range a.tokens {
+		// Compare against every token so timing doesn't reveal which
+		// one was close.
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// isReadRequest reports whether r never modifies the served tree: it is of
+// a read method, or a POST of a selection to archive. The POST must not
+// match anything fileHandler.ServeHTTP dispatches on before ?archive, or
+// it would reach tus or the index admin instead.
+func isReadRequest(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return true
+	case "POST":
+		q := r.URL.Query()
+		return q.Has("archive") && !q.Has("tus") && !q.Has("index") &&
+			r.Header.Get("Tus-Resumable") == ""
+	}
+	return false
+}
+
+// readHtpasswd parses an Apache style htpasswd file of user:hash lines.
+func readHtpasswd(name string) (map[string]string, error) {
+	users := map[string]string{}
+	err := readLines(name, func(line string) error {
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid htpasswd line %q", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("unsupported htpasswd hash for user %q (use bcrypt or SHA)", user)
+		}
+		users[user] = hash
+		return nil
+	})
+	return users, err
+}
+
+// checkHtpasswd reports whether pass matches an htpasswd bcrypt ($2y$, $2a$,
+// $2b$) or {SHA} hash.
+func checkHtpasswd(hash, pass string) bool {
+	if sum, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		h := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(sum), []byte(base64.StdEncoding.EncodeToString(h[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// readTokens reads one bearer token per line.
+func readTokens(name string) ([]string, error) {
+	var tokens []string
+	err := readLines(name, func(line string) error {
+		tokens = append(tokens, line)
+		return nil
+	})
+	return tokens, err
+}
+
+// readLines calls fn for each non-empty line of the named file that isn't
+// a '#' comment, with surrounding white space trimmed.
+func readLines(name string, fn func(line string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newGuestServer returns a guest-enabled authHandler over a fileHandler
+// serving a temporary directory with uploads, tus and an index, and the
+// path of that directory.
+func newGuestServer(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	dir := t.TempDir()
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "important.txt"), []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tokens := filepath.Join(tmp, "tokens")
+	if err := os.WriteFile(tokens, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fh := &fileHandler{root: Dir(dir), upload: true, uploadConflict: conflictOverwrite}
+	var err error
+	if fh.tus, err = newTusStore(filepath.Join(tmp, "tus"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Not started, so nothing writes to tmp behind the test's back.
+	fh.index = &fileIndex{root: dir}
+	h, err := newAuthHandler(fh, "", tokens, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, dir
+}
+
+func TestGuestArchivePost(t *testing.T) {
+	h, dir := newGuestServer(t)
+	form := url.Values{"path": {"important.txt"}}.Encode()
+	r := httptest.NewRequest("POST", "/?archive=tar", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("guest archive POST: got %d, want 200", w.Code)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "important.txt")); string(b) != "keep me" {
+		t.Errorf("important.txt = %q after archiving it", b)
+	}
+}
+
+func TestGuestArchiveBypass(t *testing.T) {
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("important.txt"))
+	tests := []struct {
+		name   string
+		target string
+		header map[string]string
+	}{
+		{"tus header", "/?archive=zip", map[string]string{
+			"Tus-Resumable": tusVersion, "Upload-Length": "0", "Upload-Metadata": meta}},
+		{"tus query", "/?archive=zip&tus", map[string]string{
+			"Tus-Resumable": tusVersion, "Upload-Length": "0", "Upload-Metadata": meta}},
+		{"index rebuild", "/?archive&index=rebuild", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, dir := newGuestServer(t)
+			r := httptest.NewRequest("POST", tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got %d, want 401", w.Code)
+			}
+			if b, _ := os.ReadFile(filepath.Join(dir, "important.txt")); string(b) != "keep me" {
+				t.Errorf("important.txt = %q after a guest request", b)
+			}
+		})
+	}
+}
+
+// newAuthServer returns an authHandler in front of a handler that answers
+// 200, with htpasswd users alice (bcrypt "wonderland") and bob (SHA
+// "builder") and the token "secret".
+func newAuthServer(t *testing.T, guest bool) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("builder"))
+	htpasswd := filepath.Join(dir, "htpasswd")
+	users := "# users\nalice:" + string(hash) + "\n\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+	if err := os.WriteFile(htpasswd, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokens, []byte("  secret  \n# not-a-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := newAuthHandler(ok, htpasswd, tokens, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		pass   string
+		bearer string
+		guest  bool
+		want   int
+	}{
+		{"none", "GET", "/", "", "", "", false, 401},
+		{"bcrypt", "GET", "/", "alice", "wonderland", "", false, 200},
+		{"bcrypt wrong", "GET", "/", "alice", "builder", "", false, 401},
+		{"sha", "PUT", "/x", "bob", "builder", "", false, 200},
+		{"sha wrong", "GET", "/", "bob", "wonderland", "", false, 401},
+		{"unknown user", "GET", "/", "carol", "wonderland", "", false, 401},
+		{"bearer", "DELETE", "/x", "", "", "secret", false, 200},
+		{"bearer wrong", "GET", "/", "", "", "secre", false, 401},
+		{"comment is no token", "GET", "/", "", "", "# not-a-token", false, 401},
+		{"query token", "GET", "/?token=secret", "", "", "", false, 200},
+		{"query token wrong", "GET", "/?token=secrets", "", "", "", false, 401},
+		{"bad basic beats good token", "GET", "/?token=secret", "alice", "nope", "", false, 401},
+		{"guest read", "GET", "/", "", "", "", true, 200},
+		{"guest head", "HEAD", "/", "", "", "", true, 200},
+		{"guest propfind", "PROPFIND", "/", "", "", "", true, 200},
+		{"guest write", "PUT", "/x", "", "", "", true, 401},
+		{"guest delete", "DELETE", "/x", "", "", "", true, 401},
+		{"guest mkcol", "MKCOL", "/x", "", "", "", true, 401},
+		{"guest upload", "POST", "/", "", "", "", true, 401},
+		{"guest archive", "POST", "/?archive=zip", "", "", "", true, 200},
+		{"guest with credentials writes", "PUT", "/x", "", "", "secret", true, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAuthServer(t, tt.guest)
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized {
+				got := w.Header().Values("WWW-Authenticate")
+				want := []string{`Basic realm="browsile", charset="UTF-8"`, `Bearer realm="browsile"`}
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("WWW-Authenticate %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthChallengeOnlyOffersConfiguredMethods(t *testing.T) {
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokens, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newAuthHandler(http.NotFoundHandler(), "", tokens, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Values("WWW-Authenticate"); len(got) != 1 || got[0] != `Bearer realm="browsile"` {
+		t.Errorf("WWW-Authenticate %q", got)
+	}
+}
+
+func TestNewAuthHandler(t *testing.T) {
+	next := http.NotFoundHandler()
+	if h, err := newAuthHandler(next, "", "", true); err != nil || h == nil {
+		t.Errorf("without auth: %v, %v", h, err)
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"no colon":  "alice\n",
+		"no user":   ":{SHA}x\n",
+		"plaintext": "alice:wonderland\n",
+		"md5":       "alice:$apr1$abc$def\n",
+	} {
+		htpasswd := filepath.Join(dir, "htpasswd")
+		if err := os.WriteFile(htpasswd, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newAuthHandler(next, htpasswd, "", false); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := newAuthHandler(next, "", filepath.Join(dir, "missing"), false); err == nil {
+		t.Errorf("missing tokens file: no error")
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type fc struct {
@@ -14,15 +20,99 @@ type fc struct {
 	TLSCertPath   string
 	DirPath       string
 	SPA           bool
+	SPAExclude    string
+	HtpasswdPath  string
+	TokensPath    string
+	Guest         bool
+	Upload        bool
+	UploadMax     string
+	UploadPolicy  string
+	TusDir        string
+	TusExpire     time.Duration
+	WebDAVPrefix  string
+	WebDAVWrite   bool
+	IndexPath     string
+	IndexRescan   time.Duration
+	IndexRebuild  bool
+	ThumbCache    string
+	ThumbCacheMax string
+	ThumbWorkers  int
+	ThumbQueue    int
+	ThumbTimeout  time.Duration
+	ThumbSize     string
+	ThumbFit      string
+	ThumbFormat   string
+	ThumbSeek     string
+	PreviewTime   time.Duration
+	HLS           bool
+	HLSDir        string
+	HLSMax        int
+	HLSIdle       time.Duration
+	PlayersPath   string
+	ArchiveStore  string
+	ArchiveZstMax int
+	ArchiveSkip   bool
+	ArchiveLinks  string
+	ArchiveFiles  bool
 }
 
 func reqLogger(H http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		u := *r.URL
+		if q := u.Query(); q.Has("token") {
+			// Keep tokens out of logs.
+			q.Set("token", "REDACTED")
+			u.RawQuery = q.Encode()
+		}
+		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, &u)
 		H.ServeHTTP(w, r)
 	})
 }
 
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+// (powers of 1024).
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	shift := 0
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n << shift, nil
+}
+
+// parseThumbSize parses a thumbnail box given as WIDTHxHEIGHT, or "0" for
+// unbounded.
+func parseThumbSize(size string) (width, height int, err error) {
+	if size == "0" {
+		return 0, 0, nil
+	}
+	w, h, ok := strings.Cut(size, "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width < 0 || height < 0 {
+		return 0, 0, fmt.Errorf("invalid thumbnail size %q", size)
+	}
+	return width, height, nil
+}
+
 func main() {
 	var Flagconfig fc
 	flag.Usage = func() {
@@ -39,6 +129,41 @@ func main() {
 	flag.StringVar(&Flagconfig.TLSKeyPath, "key", "", "<path> Path to TLS Key (Required for HTTPS)")
 	flag.StringVar(&Flagconfig.TLSCertPath, "cert", "", "<path> Path to TLS Certificate (Required for HTTPS)")
 	flag.StringVar(&Flagconfig.DirPath, "dir", ".", `<path> Directory to Serve (Default: Current Directory)`)
+	flag.BoolVar(&Flagconfig.SPA, "spa", false, "<opt>  Serve nearest index.html for missing paths (Single Page Apps)")
+	flag.StringVar(&Flagconfig.SPAExclude, "spa-exclude", "", `<list> Comma separated path prefixes kept as 404 in SPA mode (e.g. "/api/")`)
+	flag.StringVar(&Flagconfig.HtpasswdPath, "htpasswd", "", "<path> Require Basic Auth from users in htpasswd file (bcrypt or SHA)")
+	flag.StringVar(&Flagconfig.TokensPath, "tokens", "", "<path> Require one of the Bearer Tokens listed in file (one per line)")
+	flag.BoolVar(&Flagconfig.Guest, "guest", false, "<opt>  Allow read-only access without login when auth is enabled")
+	flag.BoolVar(&Flagconfig.Upload, "upload", false, "<opt>  Allow uploading files with multipart POST and PUT")
+	flag.StringVar(&Flagconfig.UploadMax, "upload-max", "1G", `<size> Maximum upload size, 0 for no limit (Default: "1G")`)
+	flag.StringVar(&Flagconfig.UploadPolicy, "upload-conflict", conflictRename, `<mode> On existing file: rename, overwrite or reject (Default: "rename")`)
+	flag.StringVar(&Flagconfig.TusDir, "tus-dir", "", `<path> Staging Directory for resumable uploads (Default: ".<dir>.tus" next to -dir)`)
+	flag.DurationVar(&Flagconfig.TusExpire, "tus-expire", 24*time.Hour, `<dur>  Remove resumable uploads idle for this long (Default: "24h")`)
+	flag.StringVar(&Flagconfig.WebDAVPrefix, "webdav", "", `<path> Serve the Directory over WebDAV under this URL prefix (e.g. "/dav/")`)
+	flag.BoolVar(&Flagconfig.WebDAVWrite, "webdav-write", false, "<opt>  Allow PUT, MKCOL, MOVE, COPY, DELETE and LOCK over WebDAV")
+	flag.StringVar(&Flagconfig.IndexPath, "index", "", "<path> Index all file names for fast search, saving the index to this file")
+	flag.DurationVar(&Flagconfig.IndexRescan, "index-rescan", 0, `<dur>  Also rebuild the index this often, 0 to rely on inotify (Default: "0s")`)
+	flag.BoolVar(&Flagconfig.IndexRebuild, "index-rebuild", false, "<opt>  Allow rebuilding the index with POST ?index=rebuild (by anyone when auth is off)")
+	flag.StringVar(&Flagconfig.ThumbCache, "thumb-cache", defaultThumbCache(), `<path> Directory to cache thumbnails in, "" to disable (Default: "browsile/thumbs" in the user cache directory)`)
+	flag.StringVar(&Flagconfig.ThumbCacheMax, "thumb-cache-max", "512M", `<size> Maximum size of the thumbnail cache, 0 for no limit (Default: "512M")`)
+	flag.IntVar(&Flagconfig.ThumbWorkers, "thumb-workers", runtime.NumCPU(), "<num>  Thumbnails made at once (Default: number of CPUs)")
+	flag.IntVar(&Flagconfig.ThumbQueue, "thumb-queue", 100, "<num>  Thumbnails waiting before answering 503 (Default: 100)")
+	flag.DurationVar(&Flagconfig.ThumbTimeout, "thumb-timeout", 30*time.Second, `<dur>  Give up making a thumbnail after this long (Default: "30s")`)
+	flag.StringVar(&Flagconfig.ThumbSize, "thumb-size", "320x320", `<size> Default thumbnail box as WIDTHxHEIGHT, 0 for unbounded (Default: "320x320")`)
+	flag.StringVar(&Flagconfig.ThumbFit, "thumb-fit", defaultThumbSpec.Fit, `<mode> Default thumbnail fit: fit in the box or crop to fill it (Default: "fit")`)
+	flag.StringVar(&Flagconfig.ThumbFormat, "thumb-format", defaultThumbSpec.Format, `<fmt>  Default thumbnail format: jpeg, png or webp (Default: "jpeg")`)
+	flag.StringVar(&Flagconfig.ThumbSeek, "thumb-seek", defaultThumbSpec.Seek, `<pos>  Default video frame position: percentage, seconds or hh:mm:ss (Default: "10%")`)
+	flag.DurationVar(&Flagconfig.PreviewTime, "preview-timeout", 2*time.Minute, `<dur>  Give up making a video preview of several frames after this long (Default: "2m")`)
+	flag.BoolVar(&Flagconfig.HLS, "hls", false, "<opt>  Allow ?stream=hls, transcoding videos browsers can't play with ffmpeg")
+	flag.StringVar(&Flagconfig.HLSDir, "hls-dir", defaultHLSDir(), `<path> Directory for HLS segments (Default: "browsile/hls" in the user cache directory)`)
+	flag.IntVar(&Flagconfig.HLSMax, "hls-max", 2, "<num>  Videos transcoded at once (Default: 2)")
+	flag.DurationVar(&Flagconfig.HLSIdle, "hls-idle", 2*time.Minute, `<dur>  Stop transcoding and remove the segments of streams idle for this long (Default: "2m")`)
+	flag.StringVar(&Flagconfig.PlayersPath, "players", "", `<path> File of external player buttons, one "label | types | URL template" per line (Default: mpv on Android)`)
+	flag.StringVar(&Flagconfig.ArchiveStore, "archive-store", defaultArchiveStore, `<list> Comma separated types and extensions zips store uncompressed, "" for none (Default: media and archives)`)
+	flag.IntVar(&Flagconfig.ArchiveZstMax, "archive-zstd-max", 9, "<num>  Highest ?level= of tar.zst archives, 1 to 22; all above 9 cost the most (Default: 9)")
+	flag.BoolVar(&Flagconfig.ArchiveSkip, "archive-skip", false, "<opt>  Leave files that can't be read out of archives, listing them in ERRORS.txt, rather than failing")
+	flag.StringVar(&Flagconfig.ArchiveLinks, "archive-links", linksStore, `<mode> Archive relative symlinks within the archive as links (store), or all as what they point to within -dir (follow); other symlinks are followed if within -dir, else left out (Default: "store")`)
+	flag.BoolVar(&Flagconfig.ArchiveFiles, "archive-files-only", false, "<opt>  Archive regular files only, without directories and symlinks, as before")
 	flag.Parse()
 
 	if len(flag.Args()) != 0 {
@@ -47,12 +172,125 @@ func main() {
 		return
 	}
 
+	uploadMax, err := parseSize(Flagconfig.UploadMax)
+	if err != nil {
+		log.Fatal("Invalid -upload-max: ", err)
+	}
+	switch Flagconfig.UploadPolicy {
+	case conflictRename, conflictOverwrite, conflictReject:
+	default:
+		log.Fatal("Invalid -upload-conflict: ", Flagconfig.UploadPolicy)
+	}
+	if Flagconfig.ArchiveZstMax < 1 || Flagconfig.ArchiveZstMax > archiveFormats["tar.zst"].maxLevel {
+		log.Fatal("Invalid -archive-zstd-max: ", Flagconfig.ArchiveZstMax)
+	}
+	switch Flagconfig.ArchiveLinks {
+	case linksStore, linksFollow:
+	default:
+		log.Fatal("Invalid -archive-links: ", Flagconfig.ArchiveLinks)
+	}
+
+	fh := &fileHandler{
+		root:           Dir(Flagconfig.DirPath),
+		spa:            Flagconfig.SPA,
+		spaExclude:     splitList(Flagconfig.SPAExclude),
+		upload:         Flagconfig.Upload,
+		uploadMax:      uploadMax,
+		uploadConflict: Flagconfig.UploadPolicy,
+		archiveStore:   splitList(Flagconfig.ArchiveStore),
+		archiveZstdMax: Flagconfig.ArchiveZstMax,
+		archiveScope: archiveScope{
+			skip:      Flagconfig.ArchiveSkip,
+			filesOnly: Flagconfig.ArchiveFiles,
+			links:     Flagconfig.ArchiveLinks,
+		},
+		archiveCRCs: newCRCCache(),
+	}
+	if Flagconfig.Upload {
+		if Flagconfig.TusDir == "" {
+			if Flagconfig.TusDir, err = defaultTusDir(Flagconfig.DirPath); err != nil {
+				log.Fatal("Invalid resumable upload options: ", err)
+			}
+		}
+		if fh.tus, err = newTusStore(Flagconfig.TusDir, Flagconfig.TusExpire); err != nil {
+			log.Fatal("Invalid resumable upload options: ", err)
+		}
+	}
+
+	if Flagconfig.IndexPath != "" {
+		if fh.index, err = newFileIndex(Dir(Flagconfig.DirPath), Flagconfig.IndexPath, Flagconfig.IndexRescan); err != nil {
+			log.Fatal("Invalid -index: ", err)
+		}
+		fh.indexRebuild = Flagconfig.IndexRebuild
+	}
+
+	if Flagconfig.ThumbCache != "" {
+		thumbCacheMax, err := parseSize(Flagconfig.ThumbCacheMax)
+		if err != nil {
+			log.Fatal("Invalid -thumb-cache-max: ", err)
+		}
+		if fh.thumbs, err = newThumbCache(Flagconfig.ThumbCache, thumbCacheMax); err != nil {
+			log.Fatal("Invalid -thumb-cache: ", err)
+		}
+	}
+
+	if Flagconfig.ThumbWorkers < 1 || Flagconfig.ThumbQueue < 0 || Flagconfig.ThumbTimeout <= 0 || Flagconfig.PreviewTime <= 0 {
+		log.Fatal("Invalid thumbnail options: -thumb-workers must be positive, -thumb-queue not negative and -thumb-timeout and -preview-timeout positive")
+	}
+	fh.previewTimeout = Flagconfig.PreviewTime
+	fh.thumbSpec = thumbSpec{Fit: Flagconfig.ThumbFit, Format: Flagconfig.ThumbFormat}
+	if fh.thumbSpec.Width, fh.thumbSpec.Height, err = parseThumbSize(Flagconfig.ThumbSize); err != nil {
+		log.Fatal("Invalid -thumb-size: ", err)
+	}
+	if fh.thumbSpec.Seek, err = parseSeek(Flagconfig.ThumbSeek); err != nil {
+		log.Fatal("Invalid -thumb-seek: ", err)
+	}
+	if err := fh.thumbSpec.check(); err != nil {
+		log.Fatal("Invalid thumbnail options: ", err)
+	}
+	fh.thumbPool = newThumbPool(Flagconfig.ThumbWorkers, Flagconfig.ThumbQueue, Flagconfig.ThumbTimeout)
+
+	if Flagconfig.HLS {
+		if Flagconfig.HLSMax < 1 || Flagconfig.HLSIdle <= 0 {
+			log.Fatal("Invalid HLS options: -hls-max and -hls-idle must be positive")
+		}
+		if fh.hls, err = newHLSServer(Flagconfig.HLSDir, Flagconfig.HLSMax, Flagconfig.HLSIdle); err != nil {
+			log.Fatal("Invalid -hls-dir: ", err)
+		}
+	}
+
+	if Flagconfig.PlayersPath != "" {
+		if fh.players, err = readPlayers(Flagconfig.PlayersPath); err != nil {
+			log.Fatal("Invalid -players: ", err)
+		}
+	}
+
+	var served http.Handler = fh
+	if prefix := Flagconfig.WebDAVPrefix; prefix != "" {
+		prefix = path.Clean("/"+prefix) + "/"
+		dav := newDavHandler(fh, prefix, Flagconfig.WebDAVWrite)
+		if prefix == "/" {
+			served = dav
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle("/", fh)
+			mux.Handle(prefix, dav)
+			served = mux
+		}
+		log.Println("Serving WebDAV on ", prefix)
+	}
+
+	handler, err := newAuthHandler(served, Flagconfig.HtpasswdPath, Flagconfig.TokensPath, Flagconfig.Guest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Serving on ", Flagconfig.ListenAddress)
 
 	if Flagconfig.TLSCertPath != "" && Flagconfig.TLSKeyPath != "" {
 		log.Println("Serving HTTPS with TLS Cert ", Flagconfig.TLSCertPath, " and TLS Key ", Flagconfig.TLSKeyPath)
-		log.Fatal(http.ListenAndServeTLS(Flagconfig.ListenAddress, Flagconfig.TLSCertPath, Flagconfig.TLSKeyPath, reqLogger(FileServer(Dir(Flagconfig.DirPath)))))
+		log.Fatal(http.ListenAndServeTLS(Flagconfig.ListenAddress, Flagconfig.TLSCertPath, Flagconfig.TLSKeyPath, reqLogger(handler)))
 	} else {
-		log.Fatal(http.ListenAndServe(Flagconfig.ListenAddress, reqLogger(FileServer(Dir(Flagconfig.DirPath)))))
+		log.Fatal(http.ListenAndServe(Flagconfig.ListenAddress, reqLogger(handler)))
 	}
 }
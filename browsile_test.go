@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":                   0,
+		"512":                 512,
+		"1K":                  1 << 10,
+		"2m":                  2 << 20,
+		" 3GB ":               3 << 30,
+		"4T":                  4 << 40,
+		"8388607T":            8388607 << 40,
+		"9223372036854775807": math.MaxInt64,
+	} {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "K", "-1", "-1K", "1.5M", "1P", "8388608T", "99999999999T", "9223372036854775808"} {
+		if got, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestParseThumbSize(t *testing.T) {
+	for in, want := range map[string][2]int{
+		"0":       {0, 0},
+		"320x240": {320, 240},
+		"0x0":     {0, 0},
+		"640x0":   {640, 0},
+	} {
+		if w, h, err := parseThumbSize(in); err != nil || w != want[0] || h != want[1] {
+			t.Errorf("parseThumbSize(%q) = %d, %d, %v, want %v", in, w, h, err, want)
+		}
+	}
+	for _, in := range []string{"", "x", "320", "320x", "x240", "320x240abc", "320x240x1", "-1x240", "320x-1", " 320x240", "320X240", "00"} {
+		if w, h, err := parseThumbSize(in); err == nil {
+			t.Errorf("parseThumbSize(%q) = %d, %d, want an error", in, w, h)
+		}
+	}
+}
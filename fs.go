@@ -7,25 +7,18 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"bytes"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"math/rand"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -76,9 +69,77 @@ func mapOpenError(originalErr error, name string, sep rune, stat func(string) (f
 // Open implements FileSystem using os.Open, opening files for reading rooted
 // and relative to the directory d.
 func (d Dir) Open(name string) (File, error) {
-	return http.Dir(string(d)).Open(name)
+	fullName, err := d.hostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullName)
+	if err != nil {
+		return nil, mapOpenError(err, fullName, filepath.Separator, os.Stat)
+	}
+	return f, nil
+}
+
+// hostPath returns the absolute native file name that Open would use for
+// name. The name is cleaned as if rooted, so it can never escape d through
+// "..", and the result never starts with "-", so external tools can't take
+// it for an option.
+func (d Dir) hostPath(name string) (string, error) {
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return "", errors.New("http: invalid character in file path")
+	}
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Abs(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name))))
+}
+
+// localPath returns an absolute native file name holding the contents of
+// name in fsys, for tools that can only read from the host file system. A Dir maps straight
+// to its host path; any other FileSystem has the file copied to a temporary
+// file. The returned cleanup func must always be called.
+func localPath(fsys FileSystem, name string) (string, func(), error) {
+	nop := func() {}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", nop, err
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		return "", nop, err
+	}
+	if d.IsDir() {
+		return "", nop, errIsDir
+	}
+	if dir, ok := fsys.(Dir); ok {
+		p, err := dir.hostPath(name)
+		return p, nop, err
+	}
+
+	tmp, err := os.CreateTemp("", "browsile-*"+path.Ext(name))
+	if err != nil {
+		return "", nop, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, f)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var p string
+	if err == nil {
+		p, err = filepath.Abs(tmp.Name())
+	}
+	if err != nil {
+		cleanup()
+		return "", nop, err
+	}
+	return p, cleanup, nil
 }
 
+var errIsDir = errors.New("is a directory")
+
 // A FileSystem implements access to a collection of named files.
 // The elements in a file path are separated by slash ('/', U+002F)
 // characters, regardless of host operating system convention.
@@ -106,23 +167,27 @@ type anyDirs interface {
 	len() int
 	name(i int) string
 	isDir(i int) bool
+	info(i int) (fs.FileInfo, error)
 }
 
 type fileInfoDirs []fs.FileInfo
 
-func (d fileInfoDirs) len() int          { return len(d) }
-func (d fileInfoDirs) isDir(i int) bool  { return d[i].IsDir() }
-func (d fileInfoDirs) name(i int) string { return d[i].Name() }
+func (d fileInfoDirs) len() int                        { return len(d) }
+func (d fileInfoDirs) isDir(i int) bool                { return d[i].IsDir() }
+func (d fileInfoDirs) name(i int) string               { return d[i].Name() }
+func (d fileInfoDirs) info(i int) (fs.FileInfo, error) { return d[i], nil }
 
 type dirEntryDirs []fs.DirEntry
 
-func (d dirEntryDirs) len() int          { return len(d) }
-func (d dirEntryDirs) isDir(i int) bool  { return d[i].IsDir() }
-func (d dirEntryDirs) name(i int) string { return d[i].Name() }
+func (d dirEntryDirs) len() int                        { return len(d) }
+func (d dirEntryDirs) isDir(i int) bool                { return d[i].IsDir() }
+func (d dirEntryDirs) name(i int) string               { return d[i].Name() }
+func (d dirEntryDirs) info(i int) (fs.FileInfo, error) { return d[i].Info() }
 
 const dirIcon = `data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAEAAAABACAYAAACqaXHeAAAABHNCSVQICAgIfAhkiAAAAAlwSFlzAAAB2AAAAdgB+lymcgAAABl0RVh0U29mdHdhcmUAd3d3Lmlua3NjYXBlLm9yZ5vuPBoAAANzSURBVHic7Zo/iFxFGMB/38zbvdztraBExERMGitFJIWJYiCmMWCqgChYSYqgh40KohjZRgKm04vamEIlFtdoirOQpFjjHy4iqUIgIUXOIoGLNpJ9tztvvhTnwuZye/tvdm/n7v2q92a+nT+//XgzO/sgJycnJycnZ6sizYsnK1osL7kPFY4Cjw3QpkP1b5CzXpMTF7+Qm4MPc3gIwIGKJrUl9zNwIHD7/yj60sJs8c/A7QbDAKS3s1cJP3mAh0Dmn5/RXUNoOwgGQD0Hh9WBwMOZuB+efk9Lw+pjEAyAiJaH3M8zk6n7BlQ6h44WM8K+juydcSep6Cj77Egy0t6Ed/cuuRd5u3FGVW4Eb1784uM3Cxfn5iTr9jOjFbDCHpQ9goZvWYUbj7ir+2bqr/1xqvhXNx8Zq3QMxBMqcvaFN/XBboI3owCAnQ3rjnUTuFkFoKpPdRO3aQUYkWJXccMeyLiTC9joAWw0W15A0I2QmRAK2w12UpCN2GLdyysHZ/W+3ZZmqtkd5qsfmMMQMAPslDC525KUx2LybRErkpTl5f2fZJ9CIAECTDxqW86Xxh+TcAQCCbAPCFII0dLoUC+3IJSA6QifpU7OQAgBArYUUe4D6lGT8TUEWAXMNkHs4IMaJVlNF6sVk0KADLDTcX37ADj9qXk5sIAkMgEKFBrms+b9QAIkAVOMTMCy/neuIpeb9wMJsNMmqrUfwNdZaL0fSEAS2dMfgMyfbr3tW4AQ3/KHU1919vvWor4FmJJE91syS+UaFfGtZX1PIcblz2f8uLps6whQEOXz1cV9CTAFwRTiEuCX9d/qR7K4urwvAbYc1+QBdNlfWKu8PwGxpT+gDb5aq7xnASJgJ+MS4BvqqpVkfq26ngXYkkS3+9OUy+3qehcQZfrrXLu63gQI2FJkux+FtGa+bFfd02zMRHxnf76mtxZOyO129T0JiG7vD2jdn1+vvicBsR1+AHivp9ar71qAmJXzv5jwddJfPi78ul7MynuCqOvUmJ2OcPlb5lKnmP8FyPVOgTGe/WcN/22nGANg8d8BbbNAkpV/f2Iia3DnwvH2y18TA/D77MQVQd+B+99dEwPbdti4sj/D12u8jkjHd/HumddzbzUOecP7wLOSMGWmhOJ2E83JrzqcT7muKW9UK/LbRo8nJycnJycnZ7y5C5Tm6jN0vhgJAAAAAElFTkSuQmCC`
 
-func dirList(w http.ResponseWriter, r *http.Request, f File) {
+// name is the '/'-separated path of the directory f.
+func (h *fileHandler) dirList(w http.ResponseWriter, r *http.Request, name string, f File) {
 	// Prefer to use ReadDir instead of Readdir,
 	// because the former doesn't require calling
 	// Stat on every entry of a directory on Unix.
@@ -142,10 +207,55 @@ func dirList(w http.ResponseWriter, r *http.Request, f File) {
 		http.Error(w, "Error reading directory", http.StatusInternalServerError)
 		return
 	}
-	sort.Slice(dirs, func(i, j int) bool { return dirs.name(i) < dirs.name(j) })
+	q := parseListQuery(r)
+	idx := selectDirs(dirs, q)
+
+	if wantsJSON(r) {
+		h.dirJSON(w, r, name, dirs, idx, q)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, listHead)
+	if h.upload {
+		fmt.Fprint(w, uploadForm)
+	}
+	searchBox(w, "")
+	listControls(w, q, len(idx))
+	fmt.Fprint(w, selectionForm)
+	fmt.Fprintf(w, `
+	  <section class="flex flex-wrap gap-0.5 my-10">
+	`)
+	fmt.Fprintf(w, "\n")
+
+	start, end := q.bounds(len(idx))
+	for _, i := range idx[start:end] {
+		info, err := dirs.info(i)
+		if err != nil {
+			// Gone since the directory was read.
+			continue
+		}
+		name := dirs.name(i)
+		if info.IsDir() {
+			name += "/"
+		}
+		h.dirCard(w, name, info)
+	}
+	fmt.Fprintf(w, `
+	</div>
+	</section>
+	`)
+	listPager(w, q, len(idx))
+	fmt.Fprint(w, metaScript)
+	fmt.Fprint(w, playerScript)
 	fmt.Fprintf(w, `
+	</body>
+	</html>	
+	`)
+}
+
+// listHead starts the HTML page of a listing.
+const listHead = `
 	<!doctype html>
 	<html lang="en" hidden>
 	  <head>
@@ -162,76 +272,227 @@ func dirList(w http.ResponseWriter, r *http.Request, f File) {
 	  <body class="mx-auto bg-gray-900 my-2" style="max-width: 90rem;">	
 
 	  <a href=".." type="button" class="text-white bg-blue-700 hover:bg-blue-800 focus:outline-none focus:ring-4 focus:ring-blue-300 font-medium rounded-full text-sm px-5 py-2.5 text-center dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 my-2 mx-auto">Back ..</a>
+	`
 
-	  <section class="flex flex-wrap gap-0.5 my-10">
-	`)
-	fmt.Fprintf(w, "\n")
+// dirCard writes the card of one listing entry. name is the entry's path
+// relative to the listed directory, ending in a slash for directories.
+func (h *fileHandler) dirCard(w io.Writer, name string, info fs.FileInfo) {
+	isDir := info.IsDir()
+	// name may contain '?' or '#', which must be escaped to remain
+	// part of the URL path, and not indicate the start of a query
+	// string or fragment.
+	urln := url.URL{Path: name}
+	urlImageView := url.URL{Path: name}
+	if !strings.HasSuffix(name, "/") {
+		urlImageView.RawQuery = url.Values{
+			"thumb": {"true"},
+			"v":     {thumbVersion(info)},
+		}.Encode()
+	}
 
-	for i, n := 0, dirs.len(); i < n; i++ {
-		name := dirs.name(i)
-		if dirs.isDir(i) {
-			name += "/"
-		}
-		// name may contain '?' or '#', which must be escaped to remain
-		// part of the URL path, and not indicate the start of a query
-		// string or fragment.
-		urln := url.URL{Path: name}
-		urlImageView := url.URL{Path: name}
-		if !strings.HasSuffix(name, "/") {
-			urlImageView.RawQuery = url.Values{
-				"thumb": {"true"},
-			}.Encode()
-		}
+	if isDir {
+		dirImg, _ := url.Parse(dirIcon)
+		urlImageView = *dirImg
+	}
 
-		if dirs.isDir(i) {
-			dirImg, _ := url.Parse(dirIcon)
-			urlImageView = *dirImg
-		}
+	// Videos play an animated preview while hovered, and go back to
+	// their thumbnail if there is none.
+	imgHover := ""
+	if !isDir && isVideoName(name) {
+		urlAnim := url.URL{Path: name, RawQuery: url.Values{
+			"preview": {"anim"},
+			"v":       {thumbVersion(info)},
+		}.Encode()}
+		imgHover = fmt.Sprintf(` data-anim="%s" onmouseenter="this.dataset.still=this.src;this.src=this.dataset.anim" onmouseleave="if(this.dataset.still)this.src=this.dataset.still" onerror="if(this.dataset.still&&this.src!=this.dataset.still)this.src=this.dataset.still"`,
+			htmlReplacer.Replace(urlAnim.String()))
+	}
 
-		name = htmlReplacer.Replace(name)
+	// Audio and video files get a line of media info, filled in by
+	// metaScript.
+	metaLine := ""
+	if !isDir && isMediaName(name) {
+		urlMeta := url.URL{Path: name, RawQuery: url.Values{
+			"meta": {"true"},
+			"v":    {thumbVersion(info)},
+		}.Encode()}
+		metaLine = fmt.Sprintf(`<p class="mb-2 text-sm text-gray-400 break-all" data-meta="%s"></p>`, htmlReplacer.Replace(urlMeta.String()))
+	}
 
-		mpvBtnClass := "hidden"
-		if !strings.HasSuffix(name, "/") {
-			mpvBtnClass = ""
-		}
+	var players strings.Builder
+	if !isDir {
+		h.playerButtons(&players, name)
+	}
 
-		dirTarBtnClass := "hidden"
-		if strings.HasSuffix(name, "/") {
-			dirTarBtnClass = ""
-		}
+	name = htmlReplacer.Replace(name)
+
+	dlBtnClass := "hidden"
+	if !strings.HasSuffix(name, "/") {
+		dlBtnClass = ""
+	}
+
+	playBtnClass := "hidden"
+	if !isDir && isMediaName(name) {
+		playBtnClass = ""
+	}
+
+	dirTarBtnClass := "hidden"
+	if strings.HasSuffix(name, "/") {
+		dirTarBtnClass = ""
+	}
 
-		fmt.Fprintf(w, `
-		<div class="max-w-sm bg-white border border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700">
+	fmt.Fprintf(w, `
+	<div class="max-w-sm bg-white border border-gray-200 rounded-lg shadow dark:bg-gray-800 dark:border-gray-700" data-href="%s">
+	<a href="%s">
+		<img loading="lazy" src="%s"%s class="min-h-40 min-w-40" alt="Thumbnail">
+	</a>
+	<div class="p-5">
 		<a href="%s">
-			<img loading="lazy" src="%s" class="min-h-40 min-w-40" alt="Thumbnail">
+			<h5  class="mb-2 text-2xl font-bold tracking-tight text-gray-900 dark:text-white break-all">%s</h5>
 		</a>
-		<div class="p-5">
-			<a href="%s">
-				<h5  class="mb-2 text-2xl font-bold tracking-tight text-gray-900 dark:text-white break-all">%s</h5>
-			</a>
-			<div class="flex">
-				<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?archive=tar">tar</a>
-				<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?dl=true">dl</a>
-				<button class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" onclick="javascript:{ 
-					const linkSource = `+"`intent://${window.location.host.toString() + window.location.pathname.toString()}%s#Intent;type=video/any;package=is.xyz.mpv;scheme=${window.location.protocol.slice(0, -1)};end;`"+`;
-					const downloadLink = document.createElement('a');
-					downloadLink.href = linkSource;
-					console.log(downloadLink)
-					downloadLink.click();
-				 }">mpv</button>
-			</div>
+		%s
+		<div class="flex items-center">
+			<input type="checkbox" name="path" value="%s" form="selection" aria-label="Select" class="w-5 h-5 mx-1 accent-blue-600">
+			<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?archive=tar">tar</a>
+			<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?playlist=m3u&amp;recursive=true">m3u</a>
+			<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?dl=true">dl</a>
+			<a class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 %s" href="%s?play=true">play</a>
+%s
 		</div>
-	</div>`, urln.String(), urlImageView.String(), urln.String(), name, dirTarBtnClass, urln.String(), mpvBtnClass, urln.String(), mpvBtnClass, urln.String())
+	</div>
+</div>`, urln.String(), urln.String(), urlImageView.String(), imgHover, urln.String(), name, metaLine, name, dirTarBtnClass, urln.String(), dirTarBtnClass, urln.String(), dlBtnClass, urln.String(), playBtnClass, urln.String(), players.String())
+}
 
+// listControls writes the sort and filter form of a directory listing of
+// n entries.
+func listControls(w io.Writer, q listQuery, n int) {
+	option := func(value, label string, selected bool) string {
+		attr := ""
+		if selected {
+			attr = " selected"
+		}
+		return fmt.Sprintf(`<option value="%s"%s>%s</option>`, value, attr, label)
 	}
 	fmt.Fprintf(w, `
-	</div>
-	</section>
-	</body>
-	</html>	
-	`)
+	  <form method="get" class="flex flex-wrap items-center gap-2 my-4 text-sm text-gray-300">
+		<input type="search" name="filter" value="%s" placeholder="Filter (e.g. *.mkv)" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white">
+		<select name="sort" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white">%s%s%s%s%s</select>
+		<select name="order" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white">%s%s</select>
+		<input type="hidden" name="per_page" value="%d">
+		<button type="submit" class="inline-flex items-center px-3 py-2 font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800">Apply</button>
+		<span>%d items</span>
+	  </form>
+	`, htmlReplacer.Replace(q.Filter),
+		option("name", "Name", q.Sort == "name"), option("natural", "Natural", q.Sort == "natural"),
+		option("size", "Size", q.Sort == "size"), option("mtime", "Modified", q.Sort == "mtime"),
+		option("type", "Type", q.Sort == "type"),
+		option("asc", "Ascending", !q.Desc), option("desc", "Descending", q.Desc),
+		q.PerPage, n)
+}
+
+// listPager writes the previous/next page links of a listing of n entries.
+func listPager(w io.Writer, q listQuery, n int) {
+	pages := q.pages(n)
+	if pages <= 1 {
+		return
+	}
+	link := func(page int, label string) string {
+		if page < 1 || page > pages {
+			return fmt.Sprintf(`<span class="px-5 py-2.5 text-gray-500">%s</span>`, label)
+		}
+		return fmt.Sprintf(`<a href="?%s" class="text-white bg-blue-700 hover:bg-blue-800 font-medium rounded-full text-sm px-5 py-2.5 dark:bg-blue-600 dark:hover:bg-blue-700">%s</a>`,
+			htmlReplacer.Replace(q.with("page", strconv.Itoa(page))), label)
+	}
+	fmt.Fprintf(w, `
+	  <nav class="flex items-center justify-center gap-4 my-6 text-gray-300">%s<span>Page %d of %d</span>%s</nav>
+	`, link(q.Page-1, "&larr; Prev"), q.Page, pages, link(q.Page+1, "Next &rarr;"))
 }
 
+// uploadForm is shown above the listing in -upload mode. Files dropped
+// anywhere on the page are sent to the current directory with tus, so an
+// upload interrupted by a dropped connection (or a reload) picks up where
+// it stopped. Without tus, the form falls back to a multipart POST.
+const uploadForm = `
+	  <form id="upload" method="post" enctype="multipart/form-data" class="my-4 p-5 border-2 border-dashed border-gray-600 rounded-lg text-gray-300 text-center">
+		<input type="file" name="file" multiple class="text-sm">
+		<button type="submit" class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800">Upload</button>
+		<p class="mt-2 text-sm">or drop files anywhere on this page</p>
+		<p id="upload-status" class="mt-2 text-sm"></p>
+		<progress id="upload-progress" class="w-full mt-2 hidden" max="100" value="0"></progress>
+	  </form>
+	  <script>
+	  (() => {
+		const form = document.getElementById('upload');
+		const status = document.getElementById('upload-status');
+		const progress = document.getElementById('upload-progress');
+		const dir = window.location.pathname;
+		const chunk = 8 << 20;
+		const tus = { 'Tus-Resumable': '1.0.0' };
+		const sleep = (ms) => new Promise((r) => setTimeout(r, ms));
+		const b64 = (s) => btoa(unescape(encodeURIComponent(s)));
+
+		const create = async (f) => {
+			const res = await fetch(dir + '?tus', { method: 'POST', headers: { ...tus,
+				'Upload-Length': f.size, 'Upload-Metadata': 'filename ' + b64(f.name) } });
+			if (res.status !== 201) throw new Error(await res.text());
+			return res.headers.get('Location');
+		};
+		const offsetOf = async (loc) => {
+			const res = await fetch(loc, { method: 'HEAD', headers: tus, cache: 'no-store' });
+			return res.ok ? Number(res.headers.get('Upload-Offset')) : -1;
+		};
+		const upload = async (f, done, total) => {
+			// Remember the upload, so a reload resumes it too.
+			const key = 'tus:' + dir + ':' + f.name + ':' + f.size + ':' + f.lastModified;
+			let loc = localStorage.getItem(key);
+			let offset = loc ? await offsetOf(loc).catch(() => -1) : -1;
+			if (offset < 0) {
+				loc = await create(f);
+				localStorage.setItem(key, loc);
+				offset = 0;
+			}
+			for (let retry = 0; offset < f.size; ) {
+				try {
+					const res = await fetch(loc, { method: 'PATCH', headers: { ...tus,
+						'Upload-Offset': offset, 'Content-Type': 'application/offset+octet-stream' },
+						body: f.slice(offset, offset + chunk) });
+					if (res.status === 404) throw new Error('upload expired');
+					if (res.status !== 204) throw new Error(await res.text());
+					offset = Number(res.headers.get('Upload-Offset'));
+					retry = 0;
+				} catch (e) {
+					if (e.message === 'upload expired' || retry++ > 30) throw e;
+					status.textContent = 'Connection lost, resuming ' + f.name + '...';
+					await sleep(Math.min(1000 * retry, 10000));
+					offset = await offsetOf(loc).catch(() => offset);
+					if (offset < 0) throw new Error('upload expired');
+				}
+				status.textContent = 'Uploading ' + f.name;
+				progress.value = 100 * (done + offset) / total;
+			}
+			localStorage.removeItem(key);
+		};
+		const send = async (files) => {
+			if (!files.length) return;
+			const total = [...files].reduce((n, f) => n + f.size, 0) || 1;
+			progress.classList.remove('hidden');
+			let done = 0;
+			try {
+				for (const f of files) {
+					await upload(f, done, total);
+					done += f.size;
+				}
+			} catch (e) {
+				alert('Upload failed: ' + e.message);
+			}
+			window.location.reload();
+		};
+		form.addEventListener('submit', (e) => { e.preventDefault(); send(form.file.files); });
+		document.addEventListener('dragover', (e) => e.preventDefault());
+		document.addEventListener('drop', (e) => { e.preventDefault(); send(e.dataTransfer.files); });
+	  })();
+	  </script>
+`
+
 var htmlReplacer = strings.NewReplacer(
 	"&", "&amp;",
 	"<", "&lt;",
@@ -314,17 +575,11 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	ctypes, haveType := w.Header()["Content-Type"]
 	var ctype string
 	if !haveType {
-		ctype = mime.TypeByExtension(filepath.Ext(name))
-		if ctype == "" {
-			// read a chunk to decide between utf-8 text and binary
-			var buf [512]byte
-			n, _ := io.ReadFull(content, buf[:])
-			ctype = http.DetectContentType(buf[:n])
-			_, err := content.Seek(0, io.SeekStart) // rewind to output whole file
-			if err != nil {
-				http.Error(w, "seeker can't seek", http.StatusInternalServerError)
-				return
-			}
+		var err error
+		ctype, err = contentType(name, content)
+		if err != nil {
+			http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+			return
 		}
 		w.Header().Set("Content-Type", ctype)
 	} else if len(ctypes) > 0 {
@@ -434,6 +689,24 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	}
 }
 
+// contentType returns the MIME type of the file called name: by its
+// extension or, failing that, by sniffing the start of content, which is
+// rewound afterwards.
+func contentType(name string, content io.ReadSeeker) (string, error) {
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		// read a chunk to decide between utf-8 text and binary
+		var buf [512]byte
+		n, _ := io.ReadFull(content, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		_, err := content.Seek(0, io.SeekStart) // rewind to output whole file
+		if err != nil {
+			return "", errSeeker
+		}
+	}
+	return ctype, nil
+}
+
 // scanETag determines if a syntactically valid ETag is present at s. If so,
 // the ETag and remaining text after consuming ETag is returned. Otherwise,
 // it returns "", "".
@@ -680,7 +953,7 @@ func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Tim
 }
 
 // name is '/'-separated, not filepath.Separator.
-func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) {
+func (h *fileHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, redirect bool) {
 	const indexPage = "/index.html"
 
 	// redirect .../index.html to .../
@@ -691,7 +964,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 		return
 	}
 
-	f, err := fs.Open(name)
+	f, err := h.root.Open(name)
 	if err != nil {
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
@@ -733,7 +1006,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 
 		// use contents of index.html for directory, if present
 		index := strings.TrimSuffix(name, "/") + indexPage
-		ff, err := fs.Open(index)
+		ff, err := h.root.Open(index)
 		if err == nil {
 			defer ff.Close()
 			dd, err := ff.Stat()
@@ -751,7 +1024,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 			return
 		}
 		setLastModified(w, d.ModTime())
-		dirList(w, r, f)
+		h.dirList(w, r, name, f)
 		return
 	}
 
@@ -818,7 +1091,7 @@ func ServeFile(w http.ResponseWriter, r *http.Request, name string) {
 		return
 	}
 	dir, file := filepath.Split(name)
-	serveFile(w, r, Dir(dir), file, false)
+	(&fileHandler{root: Dir(dir)}).serveFile(w, r, file, false)
 }
 
 func containsDotDot(v string) bool {
@@ -837,6 +1110,55 @@ func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
 
 type fileHandler struct {
 	root FileSystem
+
+	// spa serves the nearest index.html instead of a 404, except for
+	// paths starting with one of spaExclude.
+	spa        bool
+	spaExclude []string
+
+	// upload accepts multipart POSTs and PUTs of at most uploadMax
+	// bytes (0 for no limit) into a Dir root.
+	upload         bool
+	uploadMax      int64
+	uploadConflict string
+
+	// tus holds resumable uploads in progress; nil disables them.
+	tus *tusStore
+
+	// index answers searches without walking the tree; nil to walk.
+	// indexRebuild lets anyone allowed to POST rebuild it.
+	index        *fileIndex
+	indexRebuild bool
+
+	// thumbs caches generated thumbnails; nil to make them every time.
+	thumbs *thumbCache
+	// thumbPool limits how many thumbnails are made at once; nil for no
+	// limit.
+	thumbPool *thumbPool
+	// thumbSpec is how thumbnails are made; zero for defaultThumbSpec.
+	thumbSpec thumbSpec
+	// previewTimeout is how long making a ?preview= may take; 0 for the
+	// timeout of thumbPool.
+	previewTimeout time.Duration
+
+	// hls transcodes videos for ?stream=hls; nil if streaming is
+	// disabled.
+	hls *hlsServer
+
+	// players are the external player buttons of listings; nil for
+	// defaultPlayers.
+	players []externalPlayer
+
+	// archiveStore is what zips store rather than compress.
+	archiveStore typeList
+	// archiveZstdMax is the highest ?level= of tar.zst archives; 0 for
+	// that of the format.
+	archiveZstdMax int
+	// archiveScope is what archives take from the tree.
+	archiveScope archiveScope
+	// archiveCRCs caches the CRCs of files in zips that are sent in
+	// parts; nil to read them again each time.
+	archiveCRCs *crcCache
 }
 
 type ioFS struct {
@@ -934,149 +1256,113 @@ func FS(fsys fs.FS) FileSystem {
 //
 //	http.Handle("/", http.FileServer(http.FS(fsys)))
 func FileServer(root FileSystem) http.Handler {
-	return &fileHandler{root}
+	return &fileHandler{root: root}
 }
 
-const FileImg = `iVBORw0KGgoAAAANSUhEUgAAAEAAAABACAYAAACqaXHeAAAABHNCSVQICAgIfAhkiAAAAAlwSFlzAAAB2AAAAdgB+lymcgAAABl0RVh0U29mdHdhcmUAd3d3Lmlua3NjYXBlLm9yZ5vuPBoAAAL3SURBVHic7ZtbS1RRGIafNdvZYxhi6oWZHegEQ3cZYdh/UPE++g0VCP0DDz8i6jYi/0NSRHNpQkR0YhJxxg5C7hl2XxcyEaWz9l5rn9T1gFfrW2u9+/Xba70zMOA42iiTSasi/kCTGQVTCFeBMaAvSWHfttsr1XP+zSTX3IvYBtQbMgssIJxPQc8fNrZ2qJS91E0oRS0UEa/ekCWEx2k/fIegHU6uvW89S3OPyAZ8aTKPcDdNMXsRtMPJtY+t52mtH8mAekNm83j4DkEQTqTVCVoDVkV8hPk0No9DWp2gNWCgyQxwIemNTUijE7QGlGA6yQ1tSboTtNdgfVPeAJf2G3/5CR7VYGsn3sYDx+D2OFwb23t8Q7NgpeK9qJ7xb8Tb9X+iHIInuw0+NHh4gK8/4UEt/rwOQRBOJNEJUQw4brtJWiRhQuQcsB+3xuFEb/x5nVfAFlsTopwBYrq4Dboz4F9MzwTrDigKpp1QWAOUwefUIAgn1j7EywmFNcDv8YzmBa1wMo4J1mdAWjkgDIXmjxZieARVfG+lelb/Udq6A9LKAZ6nGOr36fU9SiavQ8RO6Im/dHaUSor+vjJQNl1iUruH6cod8s4BthQ2ByTF6HD3+6Swt0BWOAPyFpA31reAaQ6wRZcjopJbDrDF9vuEDkf+FcgtB9iSVI5wOSArIUXFGZC3gLxxOcBWiMsBBxyXA3QFLgcccpwBeQvIG5cDbIW4HHDAcTlAV+BywCHHGZC3gLxxOcBWyFHIAdv22+TGd11BFAPq3QYLngO6aocoZ4CihnB5v+Hrp3f/CsorXYG2AxQ8TUZL9ijFsrZGVyAi5fUGrwUuJiMrIxTvtgapXlGq1a1M3wFKtQXmklOWDSLc0T08RLwGR4fVE1Es2cvKBgXzp4aVtv0hRg4YHWROFIvmsrJBwcLIEPdj1MejvinTChaLdiYoePsL7kX9z/81Lz4iUl5vMi3CFDDO7k9ns/5hxTbwGagpxdORQZaVUu2MNTgOPL8BiGE4/SlCnXAAAAAASUVORK5CYII=`
-
-func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	upath := r.URL.Path
-	if r.URL.Query().Get("thumb") == "true" {
-		filePath := r.URL.Path
-		args := []string{}
-		args = append(args, "-s", "0", "-q", "10")
-		args = append(args, "-t", strconv.Itoa(rand.Intn(100)))
-
-		args = append(args, "-i", filePath, "-o", "/dev/stdout", "-cpng")
-		cmd := exec.Command("ffmpegthumbnailer", args...)
-		cmd.Stderr = os.Stderr
-		body, err := cmd.Output()
-		if err != nil {
-			fimg, _ := base64.StdEncoding.DecodeString(FileImg)
-			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(fimg))
-			return
-		}
-		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(body))
-		return
-	}
-
 	if !strings.HasPrefix(upath, "/") {
 		upath = "/" + upath
 		r.URL.Path = upath
 	}
+	if h.tus != nil && (r.URL.Query().Has("tus") || r.Header.Get("Tus-Resumable") != "") {
+		h.serveTus(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Has("index") {
+		h.serveIndexAdmin(w, r)
+		return
+	}
+	if r.Method == "POST" && r.URL.Query().Has("archive") {
+		h.serveArchive(w, r, path.Clean(upath))
+		return
+	}
+	if h.upload && (r.Method == "POST" || r.Method == "PUT") {
+		h.serveUpload(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Get("thumb") == "true" {
+		h.serveThumb(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Get("stream") == "hls" {
+		h.serveHLS(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Get("play") == "true" {
+		h.servePlayer(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Get("vtt") == "true" {
+		h.serveVTT(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Has("subtitle") {
+		h.serveSubtitle(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Get("meta") == "true" {
+		h.serveMeta(w, r, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Has("preview") {
+		h.servePreview(w, r, path.Clean(upath))
+		return
+	}
 	if strings.HasSuffix(upath, "/") {
-		if r.URL.Query().Get("archive") == "tar" {
-			TarDir(path.Clean(upath), w, filepath.Base(upath))
+		if r.URL.Query().Get("search") != "" {
+			h.serveSearch(w, r, path.Clean(upath))
 			return
 		}
-		if r.URL.Query().Get("archive") == "zip" {
-			ZipDir(path.Clean(upath), w, filepath.Base(upath))
+		if r.URL.Query().Has("playlist") {
+			h.servePlaylist(w, r, path.Clean(upath))
 			return
 		}
-	}
-	serveFile(w, r, f.root, path.Clean(upath), true)
-}
-
-func TarDir(dirpath string, w http.ResponseWriter, name string) {
-	w.Header().Set("Content-Type", "application/x-tar")
-	w.Header().Set("Content-disposition", `attachment; filename="`+name+`.tar"`)
-	w.WriteHeader(http.StatusOK)
-	tw := tar.NewWriter(w)
-	defer tw.Close()
-
-	_ = filepath.WalkDir(dirpath, func(p string, de fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		info, ierr := de.Info()
-		if ierr != nil {
-			return ierr
-		}
-
-		if !info.Mode().IsRegular() {
-			return nil
-		}
-
-		rel, err := filepath.Rel(dirpath, p)
-		if err != nil {
-			return err
-		}
-		f, err := os.Open(p)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		h, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
-		}
-		h.Name = rel
-		if err := tw.WriteHeader(h); err != nil {
-			return err
-		}
-		n, err := io.Copy(tw, f)
-		if info.Size() != n {
-			return fmt.Errorf("mismatch of size with %s", rel)
+		if r.URL.Query().Has("archive") {
+			h.serveArchive(w, r, path.Clean(upath))
+			return
 		}
-		return err
-	})
+	}
+	if h.spa && h.serveSPA(w, r, path.Clean(upath)) {
+		return
+	}
+	h.serveFile(w, r, path.Clean(upath), true)
 }
 
-func ZipDir(dirpath string, w http.ResponseWriter, name string) {
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-disposition", `attachment; filename="`+name+`.zip"`)
-	w.WriteHeader(http.StatusOK)
-	zw := zip.NewWriter(w)
-	defer zw.Close()
-
-	_ = filepath.WalkDir(dirpath, func(p string, de fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		info, ierr := de.Info()
-		if ierr != nil {
-			return ierr
-		}
-
-		if !info.Mode().IsRegular() {
-			return nil
-		}
-
-		rel, err := filepath.Rel(dirpath, p)
-		if err != nil {
-			return err
-		}
-		f, err := os.Open(p)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		h, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+// serveSPA serves the index.html closest to name when name doesn't exist,
+// so client side routes of a single page application resolve. It reports
+// whether it handled the request; if not, serveFile should.
+func (h *fileHandler) serveSPA(w http.ResponseWriter, r *http.Request, name string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	for _, prefix := range h.spaExclude {
+		if strings.HasPrefix(name, prefix) || name+"/" == prefix {
+			return false
 		}
+	}
+	if file, err := h.root.Open(name); err == nil {
+		file.Close()
+		return false
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
 
-		h.Name = rel
-		//h.Method = zip.Deflate
-
-		zf, err := zw.CreateHeader(h)
-		if err != nil {
-			return err
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		index, err := h.root.Open(path.Join(dir, "index.html"))
+		if err == nil {
+			defer index.Close()
+			d, err := index.Stat()
+			if err == nil && !d.IsDir() {
+				sizeFunc := func() (int64, error) { return d.Size(), nil }
+				serveContent(w, r, d.Name(), d.ModTime(), sizeFunc, index)
+				return true
+			}
 		}
-
-		n, err := io.Copy(zf, f)
-		if info.Size() != n {
-			return fmt.Errorf("mismatch of size with %s", rel)
+		if dir == "/" {
+			return false
 		}
-
-		return err
-
-	})
-
+	}
 }
 
 // httpRange specifies the byte range to be sent to the client.
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hlsSegment is the length of the segments of transcoded streams.
+	hlsSegment = 6
+	// hlsGap is how far ahead of a running transcode a segment may be
+	// asked for before the transcode restarts there instead: a seek.
+	hlsGap = 3
+	// hlsWait is how long a request waits for a segment to be made.
+	hlsWait = 60 * time.Second
+)
+
+// errHLSBusy is returned when all transcoders are in use.
+var errHLSBusy = errors.New("too many streams being transcoded")
+
+// hlsServer turns videos into HLS streams with ffmpeg for browsers that
+// can't play them. Each video being watched has a session: a directory
+// of segments, kept while the video is watched, and an ffmpeg making
+// them. At most cap(slots) ffmpegs run at once.
+type hlsServer struct {
+	dir   string
+	idle  time.Duration
+	slots chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*hlsSession
+}
+
+type hlsSession struct {
+	dir     string
+	input   string // the host path of the video
+	cleanup func() // removes input if it is a copy
+	media   *mediaInfo
+	remux   bool // copy the video stream rather than transcode it
+	live    bool // serve ffmpeg's own playlist
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd     // the running ffmpeg, or nil
+	done   chan struct{} // closed when cmd exits
+	start  int           // the first segment cmd makes
+	used   time.Time
+	closed bool
+}
+
+// newHLSServer starts a server keeping sessions in dir, running at most
+// transcoders ffmpegs, and ending sessions unused for idle.
+func newHLSServer(dir string, transcoders int, idle time.Duration) (*hlsServer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	// Sessions don't outlive the server: remove those of a previous run.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && len(e.Name()) == 64 {
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+	s := &hlsServer{
+		dir:      dir,
+		idle:     idle,
+		slots:    make(chan struct{}, transcoders),
+		sessions: map[string]*hlsSession{},
+	}
+	go s.janitor()
+	return s, nil
+}
+
+// defaultHLSDir returns the default session directory, under the user's
+// cache directory, or under the temporary directory if there is none.
+func defaultHLSDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "browsile", "hls")
+}
+
+// janitor ends idle sessions.
+func (s *hlsServer) janitor() {
+	for range time.Tick(max(s.idle/4, time.Second)) {
+		s.mu.Lock()
+		var idle []*hlsSession
+		for key, sess := range s.sessions {
+			sess.mu.Lock()
+			if time.Since(sess.used) > s.idle {
+				idle = append(idle, sess)
+				delete(s.sessions, key)
+			}
+			sess.mu.Unlock()
+		}
+		s.mu.Unlock()
+		for _, sess := range idle {
+			sess.close()
+		}
+	}
+}
+
+// session returns the session for the video name of h, starting one if
+// needed.
+func (s *hlsServer) session(h *fileHandler, name string, info fs.FileInfo, m *mediaInfo) (*hlsSession, error) {
+	key := thumbKey(h.thumbID(name), info, "hls")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[key]; ok {
+		sess.touch()
+		return sess, nil
+	}
+
+	input, cleanup, err := localPath(h.root, name)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	dir := filepath.Join(s.dir, key)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		cleanup()
+		return nil, err
+	}
+	sess := &hlsSession{dir: dir, input: input, cleanup: cleanup, media: m, used: time.Now()}
+	// Browsers play H.264 video; its keyframes decide where segments
+	// start, so the segments aren't known in advance.
+	sess.remux = m.Video[0].Codec == "h264"
+	sess.live = sess.remux || m.Duration <= 0
+	s.sessions[key] = sess
+	return sess, nil
+}
+
+func (sess *hlsSession) touch() {
+	sess.mu.Lock()
+	sess.used = time.Now()
+	sess.mu.Unlock()
+}
+
+// close stops the ffmpeg of sess and removes its segments.
+func (sess *hlsSession) close() {
+	sess.mu.Lock()
+	sess.stop()
+	sess.closed = true
+	sess.mu.Unlock()
+	os.RemoveAll(sess.dir)
+	sess.cleanup()
+}
+
+// stop kills the running ffmpeg, if any, and waits for it; sess.mu must be
+// held.
+func (sess *hlsSession) stop() {
+	if sess.cmd == nil {
+		return
+	}
+	sess.cmd.Process.Kill()
+	<-sess.done
+	sess.cmd = nil
+}
+
+// run starts ffmpeg making segments from segment start on, stopping the
+// running one; sess.mu must be held.
+func (sess *hlsSession) run(s *hlsServer, start int) error {
+	sess.stop()
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return errHLSBusy
+	}
+
+	ss := strconv.Itoa(start * hlsSegment)
+	args := []string{"-nostdin", "-v", "error"}
+	if start > 0 {
+		args = append(args, "-ss", ss)
+	}
+	args = append(args, "-i", sess.input, "-map", "0:v:0", "-map", "0:a:0?")
+	if sess.remux {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+			"-vf", "scale=-2:'min(1080,ih)'",
+			// Segments must start where the playlist says.
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegment))
+	}
+	if a := sess.media.Audio; len(a) > 0 && (a[0].Codec == "aac" || a[0].Codec == "mp3") {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-ac", "2", "-b:a", "160k")
+	}
+	if start > 0 {
+		args = append(args, "-output_ts_offset", ss)
+	}
+	args = append(args, "-f", "hls", "-hls_time", strconv.Itoa(hlsSegment), "-hls_list_size", "0",
+		"-hls_flags", "temp_file", "-hls_segment_type", "mpegts", "-start_number", strconv.Itoa(start))
+	if sess.live {
+		args = append(args, "-hls_playlist_type", "event")
+	}
+	args = append(args, "-hls_segment_filename", filepath.Join(sess.dir, "%d.ts"), filepath.Join(sess.dir, "index.m3u8"))
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		<-s.slots
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		// Being killed by stop isn't worth logging.
+		var exit *exec.ExitError
+		if err := cmd.Wait(); err != nil && (!errors.As(err, &exit) || exit.Exited()) {
+			log.Println("hls:", sess.input, err)
+		}
+		<-s.slots
+		close(done)
+	}()
+	sess.cmd, sess.done, sess.start = cmd, done, start
+	return nil
+}
+
+// segments returns the number of segments of a stream that isn't live.
+func (sess *hlsSession) segments() int {
+	return int(math.Ceil(sess.media.Duration / hlsSegment))
+}
+
+func (sess *hlsSession) segmentPath(n int) string {
+	return filepath.Join(sess.dir, strconv.Itoa(n)+".ts")
+}
+
+// ensure makes sure segment n is made or being made, starting or
+// restarting ffmpeg if needed.
+func (sess *hlsSession) ensure(s *hlsServer, n int) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.used = time.Now()
+	if sess.closed {
+		return errHLSBusy
+	}
+	if _, err := os.Stat(sess.segmentPath(n)); err == nil {
+		return nil
+	}
+	running := false
+	if sess.cmd != nil {
+		select {
+		case <-sess.done:
+		default:
+			running = true
+		}
+	}
+	if sess.live {
+		// ffmpeg makes all of a live stream in one go.
+		if running || sess.cmd != nil && n > 0 {
+			return nil
+		}
+		return sess.run(s, 0)
+	}
+	if running && n >= sess.start {
+		made := sess.start
+		for ; made <= n; made++ {
+			if _, err := os.Stat(sess.segmentPath(made)); err != nil {
+				break
+			}
+		}
+		if n <= made+hlsGap {
+			return nil
+		}
+	}
+	return sess.run(s, n)
+}
+
+// wait waits for segment n, or for the live playlist if n is negative, to
+// be made.
+func (sess *hlsSession) wait(r *http.Request, n int) error {
+	file := filepath.Join(sess.dir, "index.m3u8")
+	if n >= 0 {
+		file = sess.segmentPath(n)
+	}
+	timeout := time.NewTimer(hlsWait)
+	defer timeout.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if _, err := os.Stat(file); err == nil {
+			return nil
+		}
+		sess.mu.Lock()
+		done := sess.done
+		sess.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-timeout.C:
+			return errors.New("timed out making the stream")
+		case <-done:
+			if _, err := os.Stat(file); err == nil {
+				return nil
+			}
+			return errors.New("ffmpeg failed")
+		case <-tick.C:
+		}
+	}
+}
+
+// serveHLS replies to ?stream=hls requests for the video name: with the
+// playlist, or with segment ?seg=N of it.
+func (h *fileHandler) serveHLS(w http.ResponseWriter, r *http.Request, name string) {
+	if h.hls == nil {
+		http.Error(w, "404 page not found: streaming is disabled", http.StatusNotFound)
+		return
+	}
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	m, err := h.mediaInfo(r, name, info)
+	if err == nil && len(m.Video) == 0 {
+		err = errNoThumbnailer
+	}
+	switch {
+	case errors.Is(err, errThumbQueueFull):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case r.Context().Err() != nil:
+		return
+	case err != nil:
+		http.Error(w, "404 page not found: not a video", http.StatusNotFound)
+		return
+	}
+	sess, err := h.hls.session(h, name, info, m)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	seg := r.URL.Query().Get("seg")
+	n := -1
+	if seg != "" {
+		n, err = strconv.Atoi(seg)
+		if err != nil || n < 0 || !sess.live && n >= sess.segments() {
+			http.Error(w, "404 page not found: no such segment", http.StatusNotFound)
+			return
+		}
+	}
+	if n >= 0 || sess.live {
+		err = sess.ensure(h.hls, max(n, 0))
+		if err == nil {
+			err = sess.wait(r, n)
+		}
+		switch {
+		case errors.Is(err, errHLSBusy):
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		case r.Context().Err() != nil:
+			return
+		case err != nil:
+			http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	base := (&url.URL{Path: path.Base(name)}).String() + "?stream=hls&seg="
+	w.Header().Set("Cache-Control", "no-cache")
+	switch {
+	case n >= 0:
+		f, err := os.Open(sess.segmentPath(n))
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeContent(w, r, "", time.Time{}, f)
+	case sess.live:
+		// ffmpeg's playlist, pointing at our segment URLs.
+		data, err := os.ReadFile(filepath.Join(sess.dir, "index.m3u8"))
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		var buf bytes.Buffer
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			line := sc.Text()
+			if seg, ok := strings.CutSuffix(line, ".ts"); ok {
+				line = base + seg
+			}
+			buf.WriteString(line + "\n")
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(buf.Bytes())
+	default:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n", hlsSegment)
+		last := sess.segments() - 1
+		for i := 0; i <= last; i++ {
+			d := float64(hlsSegment)
+			if i == last {
+				d = m.Duration - float64(last*hlsSegment)
+			}
+			fmt.Fprintf(&buf, "#EXTINF:%.3f,\n%s%d\n", d, base, i)
+		}
+		buf.WriteString("#EXT-X-ENDLIST\n")
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(buf.Bytes())
+	}
+}
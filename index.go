@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileIndex is an in-memory index of every name under a Dir root, so
+// searches don't have to walk the tree. It is built by scanning the tree
+// on startup, persisted to a file so a restart can answer queries before
+// the scan finishes, and kept current with a platform file watcher
+// (inotify on Linux) and optional periodic rescans.
+type fileIndex struct {
+	root   string // host path of the indexed Dir
+	file   string // where the index is persisted, "" for nowhere
+	rescan time.Duration
+	watch  *watcher
+
+	mu      sync.RWMutex
+	dirs    map[string]map[string]indexEntry // "/a/b" -> name -> entry
+	ready   bool                             // dirs holds a whole tree
+	pending []string                         // changed during a rebuild
+	dirty   bool                             // changed since last save
+	stats   indexStats
+}
+
+// indexEntry is what the index keeps of a file; the Lstat info.
+type indexEntry struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+	Mode    fs.FileMode
+}
+
+// indexInfo is an indexEntry as an fs.FileInfo.
+type indexInfo struct {
+	name string
+	e    indexEntry
+}
+
+func (fi indexInfo) Name() string       { return fi.name }
+func (fi indexInfo) Size() int64        { return fi.e.Size }
+func (fi indexInfo) Mode() fs.FileMode  { return fi.e.Mode }
+func (fi indexInfo) ModTime() time.Time { return time.Unix(0, fi.e.ModTime) }
+func (fi indexInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi indexInfo) Sys() any           { return nil }
+
+// indexStats is reported by the ?index=status admin endpoint.
+type indexStats struct {
+	State     string    `json:"state"` // "loading", "building" or "ready"
+	Files     int       `json:"files"`
+	Dirs      int       `json:"dirs"`
+	Scanned   int       `json:"scanned"` // entries seen by the running build
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  string    `json:"duration,omitempty"`
+	Watching  bool      `json:"watching"`
+	Watches   int       `json:"watches"`
+	Events    int       `json:"events"`
+	LastEvent time.Time `json:"last_event"`
+	File      string    `json:"file,omitempty"`
+	Saved     time.Time `json:"saved"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// newFileIndex starts indexing the Dir root, persisting to file. rescan,
+// if positive, rebuilds the whole index that often.
+func newFileIndex(root Dir, file string, rescan time.Duration) (*fileIndex, error) {
+	abs, err := filepath.Abs(string(root))
+	if err != nil {
+		return nil, err
+	}
+	x := &fileIndex{root: abs, file: file, rescan: rescan}
+	x.stats.State = "loading"
+	x.stats.File = file
+	if err := x.load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("index: ignoring", file+":", err)
+	}
+	if w, err := newWatcher(); err != nil {
+		log.Println("index: not watching for changes:", err)
+	} else {
+		x.watch = w
+		x.stats.Watching = true
+		go w.run(x.refresh, func() { go x.rebuild() })
+	}
+	go x.run()
+	return x, nil
+}
+
+func (x *fileIndex) run() {
+	x.rebuild()
+
+	save := time.NewTicker(5 * time.Minute)
+	defer save.Stop()
+	var rescan <-chan time.Time
+	if x.rescan > 0 {
+		t := time.NewTicker(x.rescan)
+		defer t.Stop()
+		rescan = t.C
+	}
+	for {
+		select {
+		case <-save.C:
+			x.save()
+		case <-rescan:
+			x.rebuild()
+		}
+	}
+}
+
+// rebuild scans the whole tree into a fresh index and swaps it in. Changes
+// reported while it runs are replayed afterwards.
+func (x *fileIndex) rebuild() {
+	x.mu.Lock()
+	if x.stats.State == "building" {
+		x.mu.Unlock()
+		return
+	}
+	x.stats.State = "building"
+	x.stats.Scanned = 0
+	x.stats.Started = time.Now()
+	x.stats.Error = ""
+	x.pending = []string{}
+	x.mu.Unlock()
+
+	dirs := map[string]map[string]indexEntry{}
+	scanned := 0
+	err := x.scan("/", dirs, func() {
+		if scanned++; scanned%1024 == 0 {
+			x.mu.Lock()
+			x.stats.Scanned = scanned
+			x.mu.Unlock()
+		}
+	})
+
+	x.mu.Lock()
+	x.dirs = dirs
+	x.ready = true
+	x.dirty = true
+	pending := x.pending
+	x.pending = nil
+	x.stats.State = "ready"
+	x.stats.Scanned = scanned
+	x.stats.Finished = time.Now()
+	x.stats.Duration = x.stats.Finished.Sub(x.stats.Started).Round(time.Millisecond).String()
+	if err != nil {
+		x.stats.Error = err.Error()
+	}
+	x.mu.Unlock()
+
+	for _, rel := range pending {
+		x.refresh(rel)
+	}
+	if err != nil {
+		log.Println("index:", err)
+	}
+	log.Printf("index: %d entries indexed in %s", scanned, x.stats.Duration)
+	x.save()
+}
+
+// scan adds the tree under the directory rel to dirs, watching every
+// directory it finds. Unreadable directories are skipped.
+func (x *fileIndex) scan(rel string, dirs map[string]map[string]indexEntry, progress func()) error {
+	top := filepath.Join(x.root, filepath.FromSlash(rel))
+	return filepath.WalkDir(top, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if p == top {
+				return err
+			}
+			return nil
+		}
+		r, rerr := filepath.Rel(x.root, p)
+		if rerr != nil {
+			return rerr
+		}
+		name := path.Clean("/" + filepath.ToSlash(r))
+		if de.IsDir() {
+			if dirs[name] == nil {
+				dirs[name] = map[string]indexEntry{}
+			}
+			if x.watch != nil {
+				x.watch.add(p, name)
+			}
+		}
+		if p == top {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		dirs[path.Dir(name)][path.Base(name)] = entryOf(info)
+		if progress != nil {
+			progress()
+		}
+		return nil
+	})
+}
+
+func entryOf(info fs.FileInfo) indexEntry {
+	return indexEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Mode: info.Mode()}
+}
+
+// refresh updates the index for the path rel, which the watcher reported
+// as changed, created or removed.
+func (x *fileIndex) refresh(rel string) {
+	if rel == "/" {
+		return
+	}
+	info, err := os.Lstat(filepath.Join(x.root, filepath.FromSlash(rel)))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stats.Events++
+	x.stats.LastEvent = time.Now()
+	if x.pending != nil {
+		x.pending = append(x.pending, rel)
+	}
+	if !x.ready {
+		return
+	}
+	x.dirty = true
+	dir, name := path.Dir(rel), path.Base(rel)
+	if err != nil {
+		delete(x.dirs[dir], name)
+		x.removeTree(rel)
+		return
+	}
+	if x.dirs[dir] == nil {
+		x.dirs[dir] = map[string]indexEntry{}
+	}
+	_, known := x.dirs[dir][name]
+	x.dirs[dir][name] = entryOf(info)
+	if info.IsDir() && (!known || x.dirs[rel] == nil) {
+		// A new (or moved in) directory: pick up everything that was
+		// created in it before it was watched.
+		x.removeTree(rel)
+		x.scan(rel, x.dirs, nil)
+	}
+}
+
+// removeTree drops the directory rel and everything below it.
+func (x *fileIndex) removeTree(rel string) {
+	for dir := range x.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			delete(x.dirs, dir)
+		}
+	}
+}
+
+// status returns the index statistics with current totals.
+func (x *fileIndex) status() indexStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	stats := x.stats
+	for _, entries := range x.dirs {
+		for _, e := range entries {
+			if e.Mode.IsDir() {
+				stats.Dirs++
+			} else {
+				stats.Files++
+			}
+		}
+	}
+	if x.watch != nil {
+		stats.Watches = x.watch.count()
+	}
+	return stats
+}
+
+// search is the indexed equivalent of fileHandler.search. ok is false if
+// the index can't answer yet.
+func (x *fileIndex) search(ctx context.Context, dir string, s *searchQuery) (results []searchResult, more, ok bool, err error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if !x.ready {
+		return nil, false, false, nil
+	}
+	if _, found := x.dirs[dir]; !found {
+		return nil, false, true, fs.ErrNotExist
+	}
+	n := 0
+	for d, entries := range x.dirs {
+		if d != dir && dir != "/" && !strings.HasPrefix(d, dir+"/") {
+			continue
+		}
+		if n++; n%4096 == 0 && ctx.Err() != nil {
+			return nil, false, true, ctx.Err()
+		}
+		for name, e := range entries {
+			if !s.match(name) {
+				continue
+			}
+			rel := strings.TrimPrefix(path.Join(d, name)[len(dir):], "/")
+			if s.Depth > 0 && strings.Count(rel, "/")+1 > s.Depth {
+				continue
+			}
+			results = append(results, searchResult{rel, indexInfo{name, e}})
+		}
+	}
+	// Same order as walking the tree: a directory's children come right
+	// after it.
+	key := func(i int) string { return strings.ReplaceAll(results[i].rel, "/", "\x00") }
+	sort.Slice(results, func(i, j int) bool { return key(i) < key(j) })
+	if len(results) > s.Limit {
+		results, more = results[:s.Limit], true
+	}
+	return results, more, true, nil
+}
+
+// load reads the index saved by a previous run, if any.
+func (x *fileIndex) load() error {
+	if x.file == "" {
+		return nil
+	}
+	f, err := os.Open(x.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var saved struct {
+		Root string
+		Dirs map[string]map[string]indexEntry
+	}
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return err
+	}
+	if saved.Root != x.root {
+		return errors.New("index is of another directory")
+	}
+	x.mu.Lock()
+	x.dirs = saved.Dirs
+	x.ready = true
+	x.mu.Unlock()
+	return nil
+}
+
+// save persists the index if it changed since the last save.
+func (x *fileIndex) save() {
+	if x.file == "" {
+		return
+	}
+	x.mu.Lock()
+	if !x.dirty || !x.ready {
+		x.mu.Unlock()
+		return
+	}
+	x.dirty = false
+	x.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(x.file), ".browsile-index-*")
+	if err != nil {
+		log.Println("index:", err)
+		return
+	}
+	x.mu.RLock()
+	err = gob.NewEncoder(tmp).Encode(struct {
+		Root string
+		Dirs map[string]map[string]indexEntry
+	}{x.root, x.dirs})
+	x.mu.RUnlock()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), x.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Println("index:", err)
+		return
+	}
+	x.mu.Lock()
+	x.stats.Saved = time.Now()
+	x.mu.Unlock()
+}
+
+// serveIndexAdmin replies to ?index=status with the index statistics and
+// starts a rebuild on a POST of ?index=rebuild, if h.indexRebuild allows.
+func (h *fileHandler) serveIndexAdmin(w http.ResponseWriter, r *http.Request) {
+	if h.index == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	switch action := r.URL.Query().Get("index"); {
+	case action == "rebuild" && r.Method == "POST":
+		if !h.indexRebuild {
+			http.Error(w, "403 Forbidden: rebuilding the index needs -index-rebuild", http.StatusForbidden)
+			return
+		}
+		go h.index.rebuild()
+		w.WriteHeader(http.StatusAccepted)
+	case action == "status" && (r.Method == "GET" || r.Method == "HEAD"):
+		stats := h.index.status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"path"
+	"sync"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// watcher reports changes to the watched directories with inotify. Every
+// directory needs its own watch, so large trees may need a higher
+// fs.inotify.max_user_watches.
+type watcher struct {
+	fd int
+
+	mu      sync.Mutex
+	wds     map[int]string // watch descriptor -> directory, relative to the root
+	limited bool           // ran out of watches
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &watcher{fd: fd, wds: map[int]string{}}, nil
+}
+
+// add watches the directory at hostPath, known to the index as rel.
+func (w *watcher) add(hostPath, rel string) {
+	wd, err := syscall.InotifyAddWatch(w.fd, hostPath, watchMask)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, syscall.ENOSPC) && !w.limited {
+			w.limited = true
+			log.Println("index: out of inotify watches, raise fs.inotify.max_user_watches or use -index-rescan")
+		}
+		return
+	}
+	w.wds[wd] = rel
+}
+
+// count returns the number of watched directories.
+func (w *watcher) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.wds)
+}
+
+// run reads events until the watcher fails, calling changed with the path
+// of every entry created, removed or modified, and overflow when events
+// were lost.
+func (w *watcher) run(changed func(rel string), overflow func()) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Println("index: watcher stopped:", err)
+			return
+		}
+		for b := buf[:n]; len(b) >= syscall.SizeofInotifyEvent; {
+			wd := int(int32(binary.NativeEndian.Uint32(b[0:])))
+			mask := binary.NativeEndian.Uint32(b[4:])
+			size := int(binary.NativeEndian.Uint32(b[12:]))
+			name := b[syscall.SizeofInotifyEvent:]
+			name = name[:min(size, len(name))]
+			b = b[min(syscall.SizeofInotifyEvent+size, len(b)):]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+
+			switch {
+			case mask&syscall.IN_Q_OVERFLOW != 0:
+				overflow()
+				continue
+			case mask&syscall.IN_IGNORED != 0:
+				w.mu.Lock()
+				delete(w.wds, wd)
+				w.mu.Unlock()
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.wds[wd]
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+			if len(name) == 0 {
+				// The directory itself: deleted or its attributes changed.
+				changed(dir)
+				continue
+			}
+			changed(path.Join(dir, string(name)))
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watcher is only implemented with inotify; elsewhere the index relies on
+// -index-rescan to pick up changes.
+type watcher struct{}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (w *watcher) add(hostPath, rel string) {}
+
+func (w *watcher) count() int { return 0 }
+
+func (w *watcher) run(changed func(rel string), overflow func()) {}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIndexRebuildNeedsFlag(t *testing.T) {
+	fh := &fileHandler{root: Dir(t.TempDir())}
+	fh.index = &fileIndex{root: string(fh.root.(Dir))}
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, httptest.NewRequest("POST", "/?index=rebuild", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rebuild without -index-rebuild: got %d, want 403", w.Code)
+	}
+}
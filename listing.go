@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultPerPage = 500
+	maxPerPage     = 5000
+)
+
+// dirEntry is one entry of a JSON directory listing. URLs are relative to
+// the listed directory, like the links of the HTML listing, so they stay
+// valid when the server runs under a path prefix.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path,omitempty"` // of a search result
+	Type    string    `json:"type"`           // "dir", "file", "symlink" or "other"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Mode    string    `json:"mode"`
+	MIME    string    `json:"mime,omitempty"`
+	Target  string    `json:"target,omitempty"` // of a symlink
+	URL     string    `json:"url"`
+	Thumb   string    `json:"thumb,omitempty"`
+	Anim    string    `json:"anim,omitempty"`    // of a video
+	Sprites string    `json:"sprites,omitempty"` // WebVTT track of a video
+	Meta    string    `json:"meta,omitempty"`    // of an audio or video file
+	Play    string    `json:"play,omitempty"`    // player page of an audio or video file
+	Stream  string    `json:"stream,omitempty"`  // HLS playlist of a video
+	Tar     string    `json:"tar,omitempty"`
+	Zip     string    `json:"zip,omitempty"`
+	M3U     string    `json:"m3u,omitempty"` // playlist of the media files below a directory
+	DL      string    `json:"dl,omitempty"`
+}
+
+// dirListing is the JSON form of a directory listing.
+type dirListing struct {
+	Path    string     `json:"path"`
+	Page    int        `json:"page"`
+	PerPage int        `json:"per_page"`
+	Pages   int        `json:"pages"`
+	Total   int        `json:"total"`
+	Entries []dirEntry `json:"entries"`
+}
+
+// wantsJSON reports whether r asks for a JSON response, with ?format=json
+// or an Accept header preferring application/json.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.HasPrefix(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// listQuery holds the sorting, filtering and paging parameters of a
+// directory listing request.
+type listQuery struct {
+	Sort    string // "name", "natural", "size", "mtime" or "type"
+	Desc    bool
+	Filter  string // glob if it has any of *?[, else a substring
+	Page    int    // 1-based
+	PerPage int
+}
+
+func parseListQuery(r *http.Request) listQuery {
+	query := r.URL.Query()
+	q := listQuery{
+		Sort:   query.Get("sort"),
+		Desc:   query.Get("order") == "desc",
+		Filter: query.Get("filter"),
+	}
+	switch q.Sort {
+	case "name", "natural", "size", "mtime", "type":
+	default:
+		q.Sort = "name"
+	}
+	q.Page, _ = strconv.Atoi(query.Get("page"))
+	q.PerPage, _ = strconv.Atoi(query.Get("per_page"))
+	if q.PerPage <= 0 {
+		q.PerPage = defaultPerPage
+	}
+	q.PerPage = min(q.PerPage, maxPerPage)
+	// Past the last page the listing is empty anyway; the upper bound
+	// keeps the offset of the page, and the next page number, from
+	// overflowing.
+	q.Page = min(max(q.Page, 1), math.MaxInt/q.PerPage-1)
+	return q
+}
+
+// pages returns the number of pages n entries take.
+func (q listQuery) pages(n int) int {
+	return (n + q.PerPage - 1) / q.PerPage
+}
+
+// bounds returns the range [start, end) of n entries on page q.Page.
+func (q listQuery) bounds(n int) (start, end int) {
+	start = n
+	if q.Page <= q.pages(n) {
+		start = (q.Page - 1) * q.PerPage
+	}
+	end = min(start+q.PerPage, n)
+	return start, end
+}
+
+// with returns the query string for q with key set to value.
+func (q listQuery) with(key, value string) string {
+	v := url.Values{}
+	if q.Sort != "name" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		v.Set("order", "desc")
+	}
+	if q.Filter != "" {
+		v.Set("filter", q.Filter)
+	}
+	if q.Page != 1 {
+		v.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PerPage != defaultPerPage {
+		v.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	v.Set(key, value)
+	return v.Encode()
+}
+
+// match reports whether the entry called name passes q.Filter.
+func (q listQuery) match(name string) bool {
+	if q.Filter == "" {
+		return true
+	}
+	if strings.ContainsAny(q.Filter, "*?[") {
+		ok, _ := path.Match(strings.ToLower(q.Filter), strings.ToLower(name))
+		return ok
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(q.Filter))
+}
+
+// selectDirs returns the indexes of the entries of dirs that pass the
+// filter of q, in the order q asks for.
+func selectDirs(dirs anyDirs, q listQuery) []int {
+	idx := make([]int, 0, dirs.len())
+	for i, n := 0, dirs.len(); i < n; i++ {
+		if q.match(dirs.name(i)) {
+			idx = append(idx, i)
+		}
+	}
+
+	var infos []fs.FileInfo
+	if q.Sort == "size" || q.Sort == "mtime" {
+		infos = make([]fs.FileInfo, dirs.len())
+		for _, i := range idx {
+			infos[i], _ = dirs.info(i)
+		}
+	}
+	// cmp orders entries i and j by the sort key alone.
+	cmp := func(i, j int) int {
+		switch q.Sort {
+		case "natural":
+			return naturalCompare(dirs.name(i), dirs.name(j))
+		case "type":
+			if di, dj := dirs.isDir(i), dirs.isDir(j); di != dj {
+				if di {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(strings.ToLower(path.Ext(dirs.name(i))), strings.ToLower(path.Ext(dirs.name(j))))
+		case "size", "mtime":
+			a, b := infos[i], infos[j]
+			if a == nil || b == nil {
+				return 0
+			}
+			if q.Sort == "size" {
+				return compareInt(a.Size(), b.Size())
+			}
+			return a.ModTime().Compare(b.ModTime())
+		}
+		return 0
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		i, j := idx[a], idx[b]
+		c := cmp(i, j)
+		if c == 0 {
+			c = strings.Compare(dirs.name(i), dirs.name(j))
+		}
+		if q.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	return idx
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// naturalCompare compares a and b case-insensitively, treating runs of
+// digits as numbers, so "Episode 9" sorts before "Episode 10" and
+// "v1.2.10" after "v1.2.9".
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if c := compareInt(int64(len(na)), int64(len(nb))); c != 0 {
+				return c
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		if la, lb := unicode.ToLower(ra), unicode.ToLower(rb); la != lb {
+			return compareInt(int64(la), int64(lb))
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	return compareInt(int64(len(a)), int64(len(b)))
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// dirJSON writes the entries idx of dirs, on the page q asks for, as JSON.
+func (h *fileHandler) dirJSON(w http.ResponseWriter, r *http.Request, name string, dirs anyDirs, idx []int, q listQuery) {
+	start, end := q.bounds(len(idx))
+	list := dirListing{
+		Path:    strings.TrimSuffix(name, "/") + "/",
+		Page:    q.Page,
+		PerPage: q.PerPage,
+		Pages:   q.pages(len(idx)),
+		Total:   len(idx),
+		Entries: []dirEntry{},
+	}
+	for _, i := range idx[start:end] {
+		info, err := dirs.info(i)
+		if err != nil {
+			// Gone since the directory was read.
+			continue
+		}
+		list.Entries = append(list.Entries, h.dirEntry(path.Join(name, dirs.name(i)), dirs.name(i), info))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(list)
+}
+
+// dirEntry describes the file name with the Lstat info. rel is its path
+// relative to the directory being listed or searched.
+func (h *fileHandler) dirEntry(name, rel string, info fs.FileInfo) dirEntry {
+	e := dirEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().String(),
+	}
+	if rel != info.Name() {
+		e.Path = rel
+	}
+	u := url.URL{Path: rel}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		e.Type = "dir"
+		u.Path += "/"
+		e.Tar = u.String() + "?archive=tar"
+		e.Zip = u.String() + "?archive=zip"
+		e.M3U = u.String() + "?playlist=m3u&recursive=true"
+	case mode.IsRegular():
+		e.Type = "file"
+		e.MIME = h.fileType(name)
+		e.Thumb = u.String() + "?thumb=true&v=" + thumbVersion(info)
+		if strings.HasPrefix(e.MIME, "video/") {
+			e.Anim = u.String() + "?preview=anim&v=" + thumbVersion(info)
+			e.Sprites = u.String() + "?preview=vtt&v=" + thumbVersion(info)
+			if h.hls != nil {
+				e.Stream = u.String() + "?stream=hls"
+			}
+		}
+		if strings.HasPrefix(e.MIME, "video/") || strings.HasPrefix(e.MIME, "audio/") {
+			e.Meta = u.String() + "?meta=true&v=" + thumbVersion(info)
+			e.Play = u.String() + "?play=true"
+		}
+		e.DL = u.String() + "?dl=true"
+	case mode&fs.ModeSymlink != 0:
+		e.Type = "symlink"
+		if d, ok := h.root.(Dir); ok {
+			if p, err := d.hostPath(name); err == nil {
+				e.Target, _ = os.Readlink(p)
+			}
+		}
+	default:
+		e.Type = "other"
+	}
+	e.URL = u.String()
+	return e
+}
+
+// fileType returns the MIME type serveContent would send for name.
+func (h *fileHandler) fileType(name string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+	f, err := h.root.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	ctype, _ := contentType(name, f)
+	return ctype
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"Episode 9", "Episode 10", -1},
+		{"v1.2.10", "v1.2.9", 1},
+		{"readme", "README", 0},
+		{"file02", "file2", 0},
+		{"file002", "file10", -1},
+		{"abc", "abcd", -1},
+		{"", "a", -1},
+		{"x99999999999999999999999", "x100", 1},
+		{"a1b", "a1a", 1},
+		{"Ärger", "ärger", 0},
+		{"1", "a", -1},
+	}
+	for _, tt := range tests {
+		if got := naturalCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := naturalCompare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+
+	names := []string{"track 10.mp3", "Track 2.mp3", "track 1.mp3", "track 1b.mp3", "track 01a.mp3", "notes.txt"}
+	slices.SortStableFunc(names, naturalCompare)
+	want := []string{"notes.txt", "track 1.mp3", "track 01a.mp3", "track 1b.mp3", "Track 2.mp3", "track 10.mp3"}
+	if !slices.Equal(names, want) {
+		t.Errorf("sorted %q, want %q", names, want)
+	}
+}
+
+func TestListQueryPages(t *testing.T) {
+	for _, page := range []string{"-1", "0", "1", "3", "4", "1000", "9223372036854775807", "9223372036854775808", "-9223372036854775808"} {
+		for _, perPage := range []string{"", "1", "7", "1000000"} {
+			r := httptest.NewRequest("GET", "/?page="+page+"&per_page="+perPage, nil)
+			q := parseListQuery(r)
+			if q.Page < 1 || q.Page+1 < q.Page {
+				t.Errorf("page=%s&per_page=%s: page %d", page, perPage, q.Page)
+			}
+			for _, n := range []int{0, 1, 20, 21} {
+				start, end := q.bounds(n)
+				if start < 0 || start > end || end > n || end-start > q.PerPage {
+					t.Errorf("page=%s&per_page=%s: bounds(%d) = %d, %d", page, perPage, n, start, end)
+				}
+			}
+		}
+	}
+
+	q := listQuery{Page: 3, PerPage: 7}
+	if start, end := q.bounds(20); start != 14 || end != 20 {
+		t.Errorf("last page: bounds = %d, %d", start, end)
+	}
+	if start, end := q.bounds(14); start != 14 || end != 14 {
+		t.Errorf("past the end: bounds = %d, %d", start, end)
+	}
+}
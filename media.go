@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaInfo is what ffprobe tells of an audio or video file, as served by
+// ?meta=true.
+type mediaInfo struct {
+	Duration  float64       `json:"duration"`          // seconds
+	Format    string        `json:"format"`            // container, as ffprobe names it
+	Bitrate   int64         `json:"bitrate,omitempty"` // bits per second, of all streams
+	Video     []mediaStream `json:"video,omitempty"`
+	Audio     []mediaStream `json:"audio,omitempty"`
+	Subtitles []mediaStream `json:"subtitles,omitempty"`
+}
+
+// mediaStream is one stream of a media file; fields that don't apply to
+// its kind are left out.
+type mediaStream struct {
+	Index    int     `json:"index"` // in the file, as ffmpeg's -map takes it
+	Codec    string  `json:"codec"`
+	Profile  string  `json:"profile,omitempty"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	FPS      float64 `json:"fps,omitempty"`
+	Channels int     `json:"channels,omitempty"`
+	Layout   string  `json:"layout,omitempty"`
+	Bitrate  int64   `json:"bitrate,omitempty"`
+	Language string  `json:"language,omitempty"`
+	Title    string  `json:"title,omitempty"`
+	Default  bool    `json:"default,omitempty"`
+}
+
+// isMediaType reports whether files of type ctype may have media info.
+func isMediaType(ctype string) bool {
+	return strings.HasPrefix(ctype, "video/") || strings.HasPrefix(ctype, "audio/") ||
+		strings.HasPrefix(ctype, "application/octet-stream")
+}
+
+// isMediaName reports whether name looks like an audio or video file by
+// its extension, for listings.
+func isMediaName(name string) bool {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	return strings.HasPrefix(ctype, "video/") || strings.HasPrefix(ctype, "audio/")
+}
+
+// mediaInfo returns the media info of the file name with info, probing
+// it on the thumbnail pool unless it is in the thumbnail cache. Files
+// ffprobe can't read are cached as having none, like thumbnails.
+func (h *fileHandler) mediaInfo(r *http.Request, name string, info fs.FileInfo) (*mediaInfo, error) {
+	ctype := h.fileType(name)
+	key := thumbKey(h.thumbID(name), info, ctype+" meta")
+	body, err := h.cachedThumb(r, key, func(ctx context.Context) ([]byte, error) {
+		if info.IsDir() || !isMediaType(ctype) {
+			return nil, errNoThumbnailer
+		}
+		filePath, cleanup, err := localPath(h.root, name)
+		defer cleanup()
+		if err != nil {
+			return nil, err
+		}
+		m, err := probeMedia(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, errNoThumbnailer
+	}
+	m := new(mediaInfo)
+	return m, json.Unmarshal(body, m)
+}
+
+// serveMeta replies to ?meta=true with the media info of the file name as
+// JSON, cached by browsers like thumbnails.
+func (h *fileHandler) serveMeta(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	m, err := h.mediaInfo(r, name, info)
+	switch {
+	case errors.Is(err, errThumbQueueFull):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case r.Context().Err() != nil:
+		return
+	case err != nil:
+		if isTransient(err) {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		http.Error(w, "404 page not found: no media info for this file", http.StatusNotFound)
+		return
+	}
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setThumbCaching(w, r, thumbKey(h.thumbID(name), info, "meta"), info)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(body))
+}
+
+// probeMedia runs ffprobe on the file at filePath, killing it when ctx is
+// done.
+func probeMedia(ctx context.Context, filePath string) (*mediaInfo, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", "-i", filePath)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// ffprobe prints most numbers as strings.
+	var probe struct {
+		Streams []struct {
+			Index         int    `json:"index"`
+			CodecType     string `json:"codec_type"`
+			CodecName     string `json:"codec_name"`
+			Profile       string `json:"profile"`
+			Width         int    `json:"width"`
+			Height        int    `json:"height"`
+			AvgFrameRate  string `json:"avg_frame_rate"`
+			Channels      int    `json:"channels"`
+			ChannelLayout string `json:"channel_layout"`
+			BitRate       string `json:"bit_rate"`
+			Disposition   struct {
+				Default     int `json:"default"`
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+			Tags struct {
+				Language string `json:"language"`
+				Title    string `json:"title"`
+			} `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+	if len(probe.Streams) == 0 {
+		return nil, errors.New("ffprobe: no streams in " + filePath)
+	}
+
+	m := &mediaInfo{Format: probe.Format.FormatName}
+	m.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	m.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, s := range probe.Streams {
+		ms := mediaStream{
+			Index:    s.Index,
+			Codec:    s.CodecName,
+			Profile:  s.Profile,
+			Language: s.Tags.Language,
+			Title:    s.Tags.Title,
+			Default:  s.Disposition.Default != 0,
+		}
+		ms.Bitrate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+		switch s.CodecType {
+		case "video":
+			if s.Disposition.AttachedPic != 0 {
+				// Cover art.
+				continue
+			}
+			ms.Width, ms.Height = s.Width, s.Height
+			if num, den, ok := strings.Cut(s.AvgFrameRate, "/"); ok {
+				n, _ := strconv.ParseFloat(num, 64)
+				d, _ := strconv.ParseFloat(den, 64)
+				if d > 0 {
+					ms.FPS = float64(int(n/d*1000+0.5)) / 1000
+				}
+			}
+			m.Video = append(m.Video, ms)
+		case "audio":
+			ms.Channels, ms.Layout = s.Channels, s.ChannelLayout
+			m.Audio = append(m.Audio, ms)
+		case "subtitle":
+			m.Subtitles = append(m.Subtitles, ms)
+		}
+	}
+	return m, nil
+}
+
+// metaScript fills in the media info line of the cards of a listing as
+// they scroll into view.
+const metaScript = `
+	  <script>
+	  (() => {
+		const clock = (s) => {
+			s = Math.round(s);
+			const pad = (n) => String(n).padStart(2, '0');
+			const h = Math.floor(s / 3600), m = Math.floor(s / 60) % 60;
+			return (h ? h + ':' + pad(m) : m) + ':' + pad(s % 60);
+		};
+		const tracks = (list) => list.map((t) => t.codec + (t.layout ? ' ' + t.layout : '') +
+			(t.language ? ' (' + t.language + ')' : '')).join(', ');
+		const show = async (el) => {
+			const res = await fetch(el.dataset.meta);
+			if (!res.ok) return;
+			const m = await res.json();
+			const parts = [];
+			if (m.duration) parts.push(clock(m.duration));
+			if (m.video) parts.push(m.video[0].width + '×' + m.video[0].height + ' ' + m.video[0].codec);
+			if (m.audio) parts.push(tracks(m.audio));
+			if (m.bitrate) parts.push((m.bitrate / 1e6).toFixed(1) + ' Mb/s');
+			if (m.subtitles) parts.push(m.subtitles.length + ' subs: ' + tracks(m.subtitles));
+			el.textContent = parts.join(' · ');
+		};
+		const seen = new IntersectionObserver((entries) => entries.forEach((e) => {
+			if (!e.isIntersecting) return;
+			seen.unobserve(e.target);
+			show(e.target).catch(() => {});
+		}));
+		document.querySelectorAll('[data-meta]').forEach((el) => seen.observe(el));
+	  })();
+	  </script>
+`
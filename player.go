@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// servePlayer replies to ?play=true with a page playing the media file
+// name. It plays the file as it is if the browser says it might manage,
+// and the ?stream=hls transcode of it otherwise, or once playing it fails.
+// It offers the sidecar and embedded subtitles of the file, and carries on
+// from where it was last stopped.
+func (h *fileHandler) servePlayer(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "400 Bad Request: can't play a directory", http.StatusBadRequest)
+		return
+	}
+
+	base := (&url.URL{Path: path.Base(name)}).String()
+	stream := ""
+	if h.hls != nil {
+		stream = base + "?stream=hls"
+	}
+	tracks := h.sidecarSubtitles(name)
+	if m, err := h.mediaInfo(r, name, info); err == nil {
+		tracks = append(tracks, embeddedSubtitles(name, m)...)
+	}
+	// json.Marshal escapes <, > and &, so these are safe in a script.
+	js, _ := json.Marshal(struct {
+		Direct string          `json:"direct"`
+		Type   string          `json:"type"`
+		Stream string          `json:"stream"`
+		Tracks []subtitleTrack `json:"tracks"`
+	}{base, h.fileType(name), stream, tracks})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, playerPage, htmlReplacer.Replace(path.Base(name)), htmlReplacer.Replace(path.Base(name)), js)
+}
+
+// playerPage is the page of servePlayer, given the file name twice and its
+// sources as JSON.
+const playerPage = `
+	<!doctype html>
+	<html lang="en" hidden>
+	  <head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<title>%s</title>
+		<script type="module" src="https://cdn.skypack.dev/twind/shim"></script>
+		<script type="twind-config">
+		{
+		  "hash": true
+		}
+	  </script>
+		<script src="https://cdn.jsdelivr.net/npm/hls.js@1"></script>
+	  </head>
+	  <body class="mx-auto bg-gray-900 my-2" style="max-width: 90rem;">
+
+	  <a href="." type="button" class="text-white bg-blue-700 hover:bg-blue-800 focus:outline-none focus:ring-4 focus:ring-blue-300 font-medium rounded-full text-sm px-5 py-2.5 text-center dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800 my-2 mx-auto">Back ..</a>
+	  <h5 class="my-4 text-2xl font-bold tracking-tight text-white break-all">%s</h5>
+	  <video id="player" controls autoplay class="w-full rounded-lg bg-black"></video>
+	  <label class="flex items-center gap-2 my-4 text-sm text-gray-300">Subtitles
+		<select id="subs" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white"><option value="-1">Off</option></select>
+	  </label>
+	  <script>
+	  (() => {
+		const src = %s;
+		const video = document.getElementById('player');
+		const subs = document.getElementById('subs');
+
+		// Tracks load only once shown.
+		(src.tracks || []).forEach((t, i) => {
+			const track = document.createElement('track');
+			track.kind = 'subtitles';
+			track.label = t.label;
+			track.src = t.url;
+			if (t.lang) track.srclang = t.lang;
+			video.appendChild(track);
+			subs.add(new Option(t.label, i, false, t.default));
+		});
+		const pick = () => {
+			[...video.textTracks].forEach((t, i) => { t.mode = String(i) === subs.value ? 'showing' : 'disabled'; });
+		};
+		subs.addEventListener('change', pick);
+		pick();
+
+		// Carry on from where this file was last stopped.
+		const key = 'pos:' + window.location.pathname;
+		video.addEventListener('loadedmetadata', () => {
+			const pos = Number(localStorage.getItem(key));
+			if (pos > 0 && !(pos > video.duration - 10)) video.currentTime = pos;
+		}, { once: true });
+		let saved = 0;
+		const save = () => {
+			if (video.ended) localStorage.removeItem(key);
+			else if (video.currentTime > 0) localStorage.setItem(key, video.currentTime);
+			saved = Date.now();
+		};
+		video.addEventListener('timeupdate', () => { if (Date.now() - saved > 5000) save(); });
+		video.addEventListener('pause', save);
+		video.addEventListener('ended', save);
+		window.addEventListener('pagehide', save);
+
+		const stream = () => {
+			if (!src.stream) return;
+			if (window.Hls && Hls.isSupported()) {
+				const hls = new Hls();
+				hls.loadSource(src.stream);
+				hls.attachMedia(video);
+			} else {
+				// Safari plays HLS itself.
+				video.src = src.stream;
+			}
+		};
+		if (!src.stream || video.canPlayType(src.type)) {
+			video.addEventListener('error', stream, { once: true });
+			video.src = src.direct;
+		} else {
+			stream();
+		}
+	  })();
+	  </script>
+	</body>
+	</html>
+`
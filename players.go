@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// externalPlayer is a button on listing cards that hands a file to another
+// program through a URL. Its template is expanded in the browser, which
+// knows the URL the server is reached at, replacing:
+//
+//	{url}      the absolute URL of the file
+//	{url_enc}  the same, percent-encoded to go in a query string
+//	{scheme}   "http" or "https"
+//	{host}     the host and port of the server
+//	{path}     the absolute, escaped path of the file
+//	{name}     the file name
+//	{mime}     the MIME type of the file
+//
+// A template starting with "copy:" copies the rest to the clipboard
+// instead of opening it.
+type externalPlayer struct {
+	Label    string
+	Match    typeList
+	Template string
+}
+
+// defaultPlayers are the buttons without -players: mpv on Android, which
+// was the only one before they could be configured.
+var defaultPlayers = []externalPlayer{{
+	Label:    "mpv",
+	Match:    []string{"video/*", "audio/*"},
+	Template: "intent://{host}{path}#Intent;type=video/any;package=is.xyz.mpv;scheme={scheme};end;",
+}}
+
+// readPlayers reads one external player per line, as
+//
+//	label | matches | URL template
+//
+// where matches is a comma separated typeList.
+func readPlayers(name string) ([]externalPlayer, error) {
+	// Not nil, so that an empty file means no buttons.
+	players := []externalPlayer{}
+	err := readLines(name, func(line string) error {
+		parts := strings.SplitN(line, "|", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid player %q: want label | matches | URL template", line)
+		}
+		p := externalPlayer{
+			Label:    strings.TrimSpace(parts[0]),
+			Match:    splitList(parts[1]),
+			Template: strings.TrimSpace(parts[2]),
+		}
+		if p.Label == "" || len(p.Match) == 0 || p.Template == "" {
+			return fmt.Errorf("invalid player %q: want label | matches | URL template", line)
+		}
+		players = append(players, p)
+		return nil
+	})
+	return players, err
+}
+
+// typeList is a list of MIME types, "type/*" patterns, ".ext" extensions
+// or "*" for any file.
+type typeList []string
+
+// matches reports whether l lists files named name, of type ctype.
+func (l typeList) matches(name, ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	for _, m := range l {
+		switch {
+		case m == "*":
+			return true
+		case strings.HasPrefix(m, "."):
+			if strings.EqualFold(path.Ext(name), m) {
+				return true
+			}
+		case strings.HasSuffix(m, "/*"):
+			if strings.HasPrefix(ctype, strings.TrimSuffix(m, "*")) {
+				return true
+			}
+		case m == ctype:
+			return true
+		}
+	}
+	return false
+}
+
+// playerButtons writes the buttons of the external players for the file
+// name, relative to the listed directory. Types are guessed from the
+// extension only, as listings can't afford to sniff every file.
+func (h *fileHandler) playerButtons(w io.Writer, name string) {
+	players := h.players
+	if players == nil {
+		players = defaultPlayers
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	for _, p := range players {
+		if !p.Match.matches(name, ctype) {
+			continue
+		}
+		fmt.Fprintf(w, `
+			<button class="inline-flex items-center mx-1 px-3 py-2 text-sm font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800" data-template="%s" data-mime="%s" onclick="openPlayer(this)">%s</button>`,
+			htmlReplacer.Replace(p.Template), htmlReplacer.Replace(ctype), htmlReplacer.Replace(p.Label))
+	}
+}
+
+// playerScript defines openPlayer, which the buttons of playerButtons call
+// to expand their template and follow it.
+const playerScript = `
+	  <script>
+	  const openPlayer = (btn) => {
+		const card = btn.closest('[data-href]');
+		const u = new URL(card.dataset.href, window.location.href);
+		const vars = {
+			url: u.href,
+			url_enc: encodeURIComponent(u.href),
+			scheme: u.protocol.slice(0, -1),
+			host: u.host,
+			path: u.pathname,
+			name: decodeURIComponent(u.pathname.split('/').pop()),
+			mime: btn.dataset.mime,
+		};
+		const link = btn.dataset.template.replace(/\{(\w+)\}/g, (m, v) => v in vars ? vars[v] : m);
+		if (link.startsWith('copy:')) {
+			navigator.clipboard.writeText(link.slice(5)).then(() => {
+				const label = btn.textContent;
+				btn.textContent = 'Copied';
+				setTimeout(() => { btn.textContent = label; }, 1500);
+			});
+			return;
+		}
+		const a = document.createElement('a');
+		a.href = link;
+		a.click();
+	  };
+	  </script>
+`
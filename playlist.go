@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// playlistProbes is how many files servePlaylist probes for durations
+	// at once.
+	playlistProbes = 4
+	// playlistProbeMax is how many files of a playlist are probed at most,
+	// and playlistProbeTime how long probing may delay the reply. Files
+	// not probed by then are listed without a duration; probes cut short
+	// aren't cached as failures, so a later request picks them up.
+	playlistProbeMax  = 500
+	playlistProbeTime = 10 * time.Second
+)
+
+// servePlaylist replies to ?playlist=m3u (or m3u8) on the directory name
+// with an extended M3U of the audio and video files in it, or below it
+// with &recursive=true, in natural order. Entries have absolute URLs that
+// carry the token of the request, so players can fetch them, and
+// durations from ffprobe where it knows them.
+func (h *fileHandler) servePlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	ext := r.URL.Query().Get("playlist")
+	if ext != "m3u" && ext != "m3u8" {
+		http.Error(w, "400 Bad Request: unknown playlist format", http.StatusBadRequest)
+		return
+	}
+	recursive := r.URL.Query().Get("recursive") == "true"
+
+	var files []searchResult
+	err := walkFS(h.root, name, func(p string, info fs.FileInfo, err error) error {
+		if cerr := r.Context().Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			if p == name {
+				return err
+			}
+			// Skip what can't be read rather than failing the playlist.
+			return nil
+		}
+		if info.IsDir() && p != name && !recursive {
+			return fs.SkipDir
+		}
+		if info.Mode().IsRegular() && isMediaName(p) {
+			files = append(files, searchResult{strings.TrimPrefix(p[len(name):], "/"), info})
+		}
+		return nil
+	})
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return naturalCompare(files[i].rel, files[j].rel) < 0 })
+
+	durations := make([]int, len(files))
+	for i := range durations {
+		durations[i] = -1
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), playlistProbeTime)
+	defer cancel()
+	probe := r.WithContext(ctx)
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for i := 0; i < playlistProbes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f := files[i]
+				if m, err := h.mediaInfo(probe, path.Join(name, f.rel), f.info); err == nil && m.Duration > 0 {
+					durations[i] = int(m.Duration + 0.5)
+				}
+			}
+		}()
+	}
+feed:
+	for i := range files[:min(len(files), playlistProbeMax)] {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	base := playlistBase(r)
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for i, f := range files {
+		u := *base
+		u.Path += f.rel
+		title := strings.TrimSuffix(path.Base(f.rel), path.Ext(f.rel))
+		// A newline would end the entry.
+		title = strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", durations[i], title, u.String())
+	}
+
+	dir := path.Base(name)
+	if dir == "/" {
+		dir = "playlist"
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": dir + "." + ext}))
+	w.Write(buf.Bytes())
+}
+
+// playlistBase returns the absolute URL of the directory r is for, with the
+// bearer or query token of r in it. Basic auth credentials are never copied:
+// playlists get saved and shared, and a password must not end up in one.
+func playlistBase(r *http.Request) *url.URL {
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if token := requestToken(r); token != "" {
+		u.RawQuery = url.Values{"token": {token}}.Encode()
+	}
+	return u
+}
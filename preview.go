@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Limits and defaults of ?preview= requests.
+const (
+	maxPreviewFrames = 100
+	maxPreviewSize   = 640
+
+	// animDelay is how long each frame of an animated preview shows.
+	animDelay = 500 * time.Millisecond
+)
+
+// previewSpec describes a preview of a video made of several frames taken
+// at even intervals: a sprite sheet of them for seek bar scrubbing, or a
+// short animation of them. Like thumbSpec, it is part of the cache key.
+type previewSpec struct {
+	Mode   string // "sprite" or "anim"
+	Frames int
+	Size   int    // the longer side of each frame
+	Format string // "jpeg", "png" or "webp" for sprites; "gif" or "webp" for animations
+}
+
+var defaultPreviewSpecs = map[string]previewSpec{
+	"sprite": {Mode: "sprite", Frames: 16, Size: 160, Format: "jpeg"},
+	"anim":   {Mode: "anim", Frames: 8, Size: 320, Format: "gif"},
+}
+
+func (p previewSpec) String() string {
+	return fmt.Sprintf("preview %s %d %d %s", p.Mode, p.Frames, p.Size, p.Format)
+}
+
+// parsePreviewSpec returns the spec of a ?preview= request: the defaults
+// of mode ("sprite", "vtt" for the track of a sprite, or "anim"),
+// overridden by any of the n, size and format parameters.
+func parsePreviewSpec(r *http.Request, mode string) (previewSpec, error) {
+	query := r.URL.Query()
+	if mode == "vtt" {
+		mode = "sprite"
+	}
+	p, ok := defaultPreviewSpecs[mode]
+	if !ok {
+		return p, fmt.Errorf("unknown preview %q", mode)
+	}
+	for key, v := range map[string]*int{"n": &p.Frames, "size": &p.Size} {
+		if s := query.Get(key); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return p, fmt.Errorf("invalid %s %q", key, s)
+			}
+			*v = n
+		}
+	}
+	if p.Frames > maxPreviewFrames {
+		return p, fmt.Errorf("at most %d frames", maxPreviewFrames)
+	}
+	if p.Size > maxPreviewSize {
+		return p, fmt.Errorf("frames must be at most %d pixels", maxPreviewSize)
+	}
+	if v := query.Get("format"); v != "" {
+		p.Format = v
+	}
+	formats := "jpeg png webp"
+	if p.Mode == "anim" {
+		formats = "gif webp"
+	}
+	if !strings.Contains(" "+formats+" ", " "+p.Format+" ") {
+		return p, fmt.Errorf("unknown %s format %q", p.Mode, p.Format)
+	}
+	return p, nil
+}
+
+// isVideoName reports whether name looks like a video by its extension,
+// for listings, which can't afford to sniff every file.
+func isVideoName(name string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "video/")
+}
+
+// servePreview replies to ?preview= requests for the video name: with a
+// sprite sheet, the WebVTT thumbnails track of one, or an animation. They
+// are made on the thumbnail pool with h.previewTimeout rather than the
+// thumbnail timeout, as they take a frame per thumbnail, and cached like
+// thumbnails, but files that have no preview get a 404 rather than a
+// placeholder.
+func (h *fileHandler) servePreview(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "400 Bad Request: no preview of a directory", http.StatusBadRequest)
+		return
+	}
+	mode := r.URL.Query().Get("preview")
+	p, err := parsePreviewSpec(r, mode)
+	if err != nil {
+		http.Error(w, "invalid preview: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctype := h.fileType(name)
+	key := thumbKey(h.thumbID(name), info, ctype+" "+p.String())
+	body, err := h.cachedThumbWithin(r, key, h.previewTimeout, func(ctx context.Context) ([]byte, error) {
+		if !strings.HasPrefix(ctype, "video/") && !strings.HasPrefix(ctype, "application/octet-stream") {
+			return nil, errNoThumbnailer
+		}
+		return makePreview(ctx, h.root, name, p)
+	})
+	if mode == "vtt" && len(body) > 0 {
+		sprite := body
+		key = thumbKey(h.thumbID(name), info, p.String()+" vtt")
+		body = nil
+		var m *mediaInfo
+		if m, err = h.mediaInfo(r, name, info); err == nil {
+			body, err = spriteTrack(name, info, p, sprite, m.Duration)
+		}
+	}
+	switch {
+	case errors.Is(err, errThumbQueueFull):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case r.Context().Err() != nil:
+		return
+	case len(body) == 0:
+		if isTransient(err) {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		http.Error(w, "404 page not found: no preview of this file", http.StatusNotFound)
+		return
+	}
+
+	if mode == "vtt" {
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	}
+	setThumbCaching(w, r, key, info)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(body))
+}
+
+// makePreview takes p.Frames frames evenly spread over the video name and
+// makes a sprite sheet or an animation of them.
+func makePreview(ctx context.Context, fsys FileSystem, name string, p previewSpec) ([]byte, error) {
+	filePath, cleanup, err := localPath(fsys, name)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []image.Image
+	var tile image.Rectangle
+	for i := 0; i < p.Frames; i++ {
+		// In the middle of each of p.Frames equal parts.
+		pct := (200*i + 100) / (2 * p.Frames)
+		frame, err := videoFrame(ctx, filePath, p.Size, strconv.Itoa(pct)+"%")
+		if err != nil {
+			if i == 0 || ctx.Err() != nil {
+				return nil, err
+			}
+			// Some videos can't be seeked everywhere.
+			frames = append(frames, frames[i-1])
+			continue
+		}
+		if i == 0 {
+			b := frame.Bounds()
+			w, h := fitSize(b.Dx(), b.Dy(), p.Size, p.Size)
+			tile = image.Rect(0, 0, w, h)
+		}
+		// Frames are scaled to the size of the first, should they
+		// differ.
+		dst := image.NewNRGBA(tile)
+		draw.CatmullRom.Scale(dst, tile, frame, frame.Bounds(), draw.Src, nil)
+		frames = append(frames, dst)
+	}
+
+	if p.Mode == "anim" {
+		var buf bytes.Buffer
+		if p.Format == "webp" {
+			err = encodeAnimatedWebP(&buf, frames, animDelay)
+		} else {
+			err = encodeGIF(&buf, frames, animDelay)
+		}
+		return buf.Bytes(), err
+	}
+	cols, rows := spriteGrid(p.Frames)
+	sheet := image.NewNRGBA(image.Rect(0, 0, cols*tile.Dx(), rows*tile.Dy()))
+	draw.Draw(sheet, sheet.Rect, image.Black, image.Point{}, draw.Src)
+	for i, frame := range frames {
+		at := image.Pt(i%cols*tile.Dx(), i/cols*tile.Dy())
+		draw.Draw(sheet, tile.Add(at), frame, image.Point{}, draw.Src)
+	}
+	return encodeThumb(sheet, p.Format)
+}
+
+// spriteGrid returns the columns and rows of a sprite sheet of n frames,
+// as square as it gets.
+func spriteGrid(n int) (cols, rows int) {
+	cols = int(math.Ceil(math.Sqrt(float64(n))))
+	return cols, (n + cols - 1) / cols
+}
+
+// encodeGIF writes frames as an animated GIF that shows each for delay
+// and loops forever.
+func encodeGIF(w io.Writer, frames []image.Image, delay time.Duration) error {
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		pm := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(pm, pm.Rect, frame, frame.Bounds().Min)
+		anim.Image = append(anim.Image, pm)
+		anim.Delay = append(anim.Delay, int(delay/(10*time.Millisecond)))
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// spriteTrack returns the WebVTT thumbnails track of the sprite sheet of
+// the video name made as p says: one cue per frame, pointing at the frame
+// in the sheet with a media fragment, which players show when hovering
+// the seek bar. duration is the length of the video in seconds.
+func spriteTrack(name string, info fs.FileInfo, p previewSpec, sprite []byte, duration float64) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(sprite))
+	if err != nil {
+		return nil, err
+	}
+	cols, rows := spriteGrid(p.Frames)
+	tw, th := cfg.Width/cols, cfg.Height/rows
+	if duration <= 0 {
+		return nil, errors.New("unknown duration")
+	}
+
+	u := url.URL{Path: path.Base(name)}
+	u.RawQuery = fmt.Sprintf("preview=sprite&n=%d&size=%d&format=%s&v=%s", p.Frames, p.Size, p.Format, thumbVersion(info))
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	step := time.Duration(duration * float64(time.Second) / float64(p.Frames))
+	for i := 0; i < p.Frames; i++ {
+		fmt.Fprintf(&buf, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTime(step*time.Duration(i)), vttTime(step*time.Duration(i+1)),
+			u.String(), i%cols*tw, i/cols*th, tw, th)
+	}
+	return buf.Bytes(), nil
+}
+
+// vttTime formats d as a WebVTT timestamp.
+func vttTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
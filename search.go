@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 1000
+	maxSearchLimit     = 10000
+)
+
+// searchQuery holds the parameters of a ?search= request. Patterns are
+// matched case-insensitively against file names, not their paths.
+type searchQuery struct {
+	Pattern string
+	Mode    string // "substring", "glob" or "regex"
+	Depth   int    // 0 for no limit
+	Limit   int
+	re      *regexp.Regexp
+}
+
+func parseSearchQuery(r *http.Request) (*searchQuery, error) {
+	query := r.URL.Query()
+	s := &searchQuery{
+		Pattern: query.Get("search"),
+		Mode:    query.Get("mode"),
+	}
+	s.Depth, _ = strconv.Atoi(query.Get("depth"))
+	s.Limit, _ = strconv.Atoi(query.Get("limit"))
+	if s.Limit <= 0 {
+		s.Limit = defaultSearchLimit
+	}
+	s.Limit = min(s.Limit, maxSearchLimit)
+	switch s.Mode {
+	case "":
+		s.Mode = "substring"
+		if strings.ContainsAny(s.Pattern, "*?[") {
+			s.Mode = "glob"
+		}
+	case "substring":
+	case "glob":
+		if _, err := path.Match(s.Pattern, ""); err != nil {
+			return nil, err
+		}
+	case "regex":
+		re, err := regexp.Compile("(?i)" + s.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.re = re
+	default:
+		return nil, fmt.Errorf("unknown search mode %q", s.Mode)
+	}
+	return s, nil
+}
+
+func (s *searchQuery) match(name string) bool {
+	switch s.Mode {
+	case "glob":
+		ok, _ := path.Match(strings.ToLower(s.Pattern), strings.ToLower(name))
+		return ok
+	case "regex":
+		return s.re.MatchString(name)
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(s.Pattern))
+}
+
+// searchResult is a file found under the searched directory.
+type searchResult struct {
+	rel  string // path relative to the searched directory
+	info fs.FileInfo
+}
+
+// search walks the tree under dir, or looks it up in the index, and
+// returns up to s.Limit matches, and whether there were more. It stops
+// early with the context error once the client has gone away.
+func (h *fileHandler) search(r *http.Request, dir string, s *searchQuery) ([]searchResult, bool, error) {
+	if h.index != nil {
+		if results, more, ok, err := h.index.search(r.Context(), dir, s); ok {
+			return results, more, err
+		}
+	}
+	var results []searchResult
+	more := false
+	err := walkFS(h.root, dir, func(name string, info fs.FileInfo, err error) error {
+		if cerr := r.Context().Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			// Skip what can't be read rather than failing the search.
+			return nil
+		}
+		if name == dir {
+			return nil
+		}
+		rel := strings.TrimPrefix(name[len(dir):], "/")
+		if s.match(info.Name()) {
+			if len(results) == s.Limit {
+				more = true
+				return fs.SkipAll
+			}
+			results = append(results, searchResult{rel, info})
+		}
+		if info.IsDir() && s.Depth > 0 && strings.Count(rel, "/")+1 >= s.Depth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return results, more, err
+}
+
+// serveSearch replies to ?search= on the directory name with the matching
+// files, as cards like dirList or as JSON.
+func (h *fileHandler) serveSearch(w http.ResponseWriter, r *http.Request, name string) {
+	s, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, "invalid search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, more, err := h.search(r, name, s)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	if wantsJSON(r) {
+		list := struct {
+			Path      string     `json:"path"`
+			Search    string     `json:"search"`
+			Mode      string     `json:"mode"`
+			Total     int        `json:"total"`
+			Truncated bool       `json:"truncated"`
+			Entries   []dirEntry `json:"entries"`
+		}{strings.TrimSuffix(name, "/") + "/", s.Pattern, s.Mode, len(results), more, []dirEntry{}}
+		for _, res := range results {
+			list.Entries = append(list.Entries, h.dirEntry(path.Join(name, res.rel), res.rel, res.info))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+
+	note := ""
+	if more {
+		note = fmt.Sprintf(" (only the first %d shown)", s.Limit)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, listHead)
+	searchBox(w, s.Pattern)
+	fmt.Fprint(w, selectionForm)
+	fmt.Fprintf(w, `
+	  <p class="my-4 text-sm text-gray-300">%d results for %s%s</p>
+	  <section class="flex flex-wrap gap-0.5 my-10">
+	`, len(results), htmlReplacer.Replace(strconv.Quote(s.Pattern)), note)
+	for _, res := range results {
+		rel := res.rel
+		if res.info.IsDir() {
+			rel += "/"
+		}
+		h.dirCard(w, rel, res.info)
+	}
+	fmt.Fprint(w, metaScript)
+	fmt.Fprint(w, playerScript)
+	fmt.Fprintf(w, `
+	</section>
+	</body>
+	</html>
+	`)
+}
+
+// searchBox writes the form for a recursive search of the current
+// directory.
+func searchBox(w io.Writer, pattern string) {
+	fmt.Fprintf(w, `
+	  <form method="get" class="flex flex-wrap items-center gap-2 my-4 text-sm text-gray-300">
+		<input type="search" name="search" value="%s" placeholder="Search this folder and below" class="flex-grow px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white">
+		<select name="mode" class="px-3 py-2 rounded-lg bg-gray-800 border border-gray-600 text-white"><option value="">Auto</option><option value="substring">Substring</option><option value="glob">Glob</option><option value="regex">Regex</option></select>
+		<button type="submit" class="inline-flex items-center px-3 py-2 font-medium text-center text-white bg-blue-700 rounded-lg hover:bg-blue-800 focus:ring-4 focus:outline-none focus:ring-blue-300 dark:bg-blue-600 dark:hover:bg-blue-700 dark:focus:ring-blue-800">Search</button>
+	  </form>
+	`, htmlReplacer.Replace(pattern))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// subtitleExts are the extensions of sidecar subtitles the player picks up.
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true, ".ass": true, ".ssa": true}
+
+// textSubtitleCodecs are the embedded subtitle codecs ffmpeg can turn into
+// WebVTT; the others are pictures.
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true, "webvtt": true, "mov_text": true, "text": true,
+}
+
+// subtitleTrack is a subtitle track of the player page.
+type subtitleTrack struct {
+	Label   string `json:"label"`
+	Lang    string `json:"lang,omitempty"`
+	URL     string `json:"url"` // of its WebVTT, relative to the directory
+	Default bool   `json:"default,omitempty"`
+}
+
+// sidecarSubtitles returns the subtitles next to the media file name: the
+// files named like it with a subtitle extension instead of its own, with
+// maybe a label such as a language in between, as in "movie.en.srt".
+func (h *fileHandler) sidecarSubtitles(name string) []subtitleTrack {
+	dir, file := path.Dir(name), path.Base(name)
+	stem := strings.TrimSuffix(file, path.Ext(file))
+	d, err := h.root.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return nil
+	}
+	var tracks []subtitleTrack
+	for _, info := range infos {
+		sub := info.Name()
+		ext := strings.ToLower(path.Ext(sub))
+		if info.IsDir() || !subtitleExts[ext] {
+			continue
+		}
+		label, ok := strings.CutPrefix(strings.TrimSuffix(sub, path.Ext(sub)), stem)
+		if !ok || label != "" && label[0] != '.' {
+			continue
+		}
+		t := subtitleTrack{Label: strings.TrimPrefix(label, "."), URL: (&url.URL{Path: sub}).String() + "?vtt=true"}
+		if lang, _, _ := strings.Cut(t.Label, "."); len(lang) == 2 || len(lang) == 3 {
+			t.Lang = lang
+		}
+		if t.Label == "" {
+			t.Label = strings.ToUpper(ext[1:])
+		}
+		tracks = append(tracks, t)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].URL < tracks[j].URL })
+	return tracks
+}
+
+// embeddedSubtitles returns the text subtitle streams of the media file
+// name, which ?subtitle= extracts.
+func embeddedSubtitles(name string, m *mediaInfo) []subtitleTrack {
+	var tracks []subtitleTrack
+	for _, s := range m.Subtitles {
+		if !textSubtitleCodecs[s.Codec] {
+			continue
+		}
+		t := subtitleTrack{
+			Label:   s.Title,
+			Lang:    s.Language,
+			URL:     (&url.URL{Path: path.Base(name)}).String() + "?subtitle=" + strconv.Itoa(s.Index),
+			Default: s.Default,
+		}
+		if t.Label == "" {
+			t.Label = s.Language
+		}
+		if t.Label == "" {
+			t.Label = "Track " + strconv.Itoa(s.Index)
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// serveVTT replies to ?vtt=true on the subtitle file name with it as
+// WebVTT: SRT is converted here, ASS by ffmpeg.
+func (h *fileHandler) serveVTT(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	var body []byte
+	switch strings.ToLower(path.Ext(name)) {
+	case ".vtt":
+		body, err = io.ReadAll(f)
+	case ".srt":
+		var srt []byte
+		if srt, err = io.ReadAll(f); err == nil {
+			body = srtToVTT(srt)
+		}
+	case ".ass", ".ssa":
+		key := thumbKey(h.thumbID(name), info, "vtt")
+		body, err = h.cachedThumb(r, key, func(ctx context.Context) ([]byte, error) {
+			return ffmpegVTT(ctx, h.root, name, "0:s:0")
+		})
+	default:
+		http.Error(w, "400 Bad Request: not a subtitle file", http.StatusBadRequest)
+		return
+	}
+	h.serveVTTBody(w, r, info, body, err)
+}
+
+// serveSubtitle replies to ?subtitle=N on the media file name with its
+// stream N as WebVTT, extracted with ffmpeg.
+func (h *fileHandler) serveSubtitle(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("subtitle"))
+	if err != nil {
+		http.Error(w, "400 Bad Request: invalid subtitle stream", http.StatusBadRequest)
+		return
+	}
+	m, err := h.mediaInfo(r, name, info)
+	if err == nil {
+		err = errNoThumbnailer
+		for _, s := range m.Subtitles {
+			if s.Index == index && textSubtitleCodecs[s.Codec] {
+				err = nil
+			}
+		}
+	}
+	var body []byte
+	if err == nil {
+		key := thumbKey(h.thumbID(name), info, "subtitle "+strconv.Itoa(index))
+		body, err = h.cachedThumb(r, key, func(ctx context.Context) ([]byte, error) {
+			return ffmpegVTT(ctx, h.root, name, "0:"+strconv.Itoa(index))
+		})
+	}
+	h.serveVTTBody(w, r, info, body, err)
+}
+
+// serveVTTBody replies with the WebVTT subtitles made of the file with
+// info, or with the error making them.
+func (h *fileHandler) serveVTTBody(w http.ResponseWriter, r *http.Request, info fs.FileInfo, body []byte, err error) {
+	switch {
+	case errors.Is(err, errThumbQueueFull):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case r.Context().Err() != nil:
+		return
+	case errors.Is(err, errNoThumbnailer), err == nil && len(body) == 0:
+		http.Error(w, "404 page not found: no such subtitles", http.StatusNotFound)
+		return
+	case err != nil:
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(body))
+}
+
+// ffmpegVTT returns the subtitle stream spec, as -map takes it, of the
+// file name as WebVTT.
+func ffmpegVTT(ctx context.Context, fsys FileSystem, name, stream string) ([]byte, error) {
+	filePath, cleanup, err := localPath(fsys, name)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-nostdin", "-v", "error", "-i", filePath, "-map", stream, "-f", "webvtt", "-")
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	return cmd.Output()
+}
+
+// srtToVTT converts SubRip subtitles to WebVTT. Files that aren't UTF-8
+// are taken to be Latin-1, the most common other encoding of SRT.
+func srtToVTT(srt []byte) []byte {
+	srt = bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))
+	text := string(srt)
+	if !utf8.Valid(srt) {
+		runes := make([]rune, len(srt))
+		for i, b := range srt {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "-->") {
+			// 00:01:02,345 --> 00:01:03,456 becomes 00:01:02.345 --> ...
+			line = strings.ReplaceAll(line, ",", ".")
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
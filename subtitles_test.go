@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestSrtToVTT(t *testing.T) {
+	tests := []struct {
+		name, srt, want string
+	}{
+		{
+			"plain",
+			"1\n00:00:01,000 --> 00:00:02,500\nHello, world\n\n2\n00:01:02,345 --> 00:01:03,456\nBye\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello, world\n\n2\n00:01:02.345 --> 00:01:03.456\nBye\n\n",
+		},
+		{
+			"bom and crlf",
+			"\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000\r\nHi\r\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nHi\n\n",
+		},
+		{
+			"old mac line ends",
+			"1\r00:00:01,000 --> 00:00:02,000\rHi",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nHi\n",
+		},
+		{
+			"latin-1",
+			"1\n00:00:01,000 --> 00:00:02,000\nGr\xfc\xdfe, Fran\xe7ois\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nGrüße, François\n\n",
+		},
+		{
+			"utf-8 kept",
+			"1\n00:00:01,000 --> 00:00:02,000\nGrüße\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nGrüße\n\n",
+		},
+		{"empty", "", "WEBVTT\n\n\n"},
+	}
+	for _, tt := range tests {
+		if got := string(srtToVTT([]byte(tt.srt))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FileImg = `iVBORw0KGgoAAAANSUhEUgAAAEAAAABACAYAAACqaXHeAAAABHNCSVQICAgIfAhkiAAAAAlwSFlzAAAB2AAAAdgB+lymcgAAABl0RVh0U29mdHdhcmUAd3d3Lmlua3NjYXBlLm9yZ5vuPBoAAAL3SURBVHic7ZtbS1RRGIafNdvZYxhi6oWZHegEQ3cZYdh/UPE++g0VCP0DDz8i6jYi/0NSRHNpQkR0YhJxxg5C7hl2XxcyEaWz9l5rn9T1gFfrW2u9+/Xba70zMOA42iiTSasi/kCTGQVTCFeBMaAvSWHfttsr1XP+zSTX3IvYBtQbMgssIJxPQc8fNrZ2qJS91E0oRS0UEa/ekCWEx2k/fIegHU6uvW89S3OPyAZ8aTKPcDdNMXsRtMPJtY+t52mtH8mAekNm83j4DkEQTqTVCVoDVkV8hPk0No9DWp2gNWCgyQxwIemNTUijE7QGlGA6yQ1tSboTtNdgfVPeAJf2G3/5CR7VYGsn3sYDx+D2OFwb23t8Q7NgpeK9qJ7xb8Tb9X+iHIInuw0+NHh4gK8/4UEt/rwOQRBOJNEJUQw4brtJWiRhQuQcsB+3xuFEb/x5nVfAFlsTopwBYrq4Dboz4F9MzwTrDigKpp1QWAOUwefUIAgn1j7EywmFNcDv8YzmBa1wMo4J1mdAWjkgDIXmjxZieARVfG+lelb/Udq6A9LKAZ6nGOr36fU9SiavQ8RO6Im/dHaUSor+vjJQNl1iUruH6cod8s4BthQ2ByTF6HD3+6Swt0BWOAPyFpA31reAaQ6wRZcjopJbDrDF9vuEDkf+FcgtB9iSVI5wOSArIUXFGZC3gLxxOcBWiMsBBxyXA3QFLgcccpwBeQvIG5cDbIW4HHDAcTlAV+BywCHHGZC3gLxxOcBWyFHIAdv22+TGd11BFAPq3QYLngO6aocoZ4CihnB5v+Hrp3f/CsorXYG2AxQ8TUZL9ijFsrZGVyAi5fUGrwUuJiMrIxTvtgapXlGq1a1M3wFKtQXmklOWDSLc0T08RLwGR4fVE1Es2cvKBgXzp4aVtv0hRg4YHWROFIvmsrJBwcLIEPdj1MejvinTChaLdiYoePsL7kX9z/81Lz4iUl5vMi3CFDDO7k9ns/5hxTbwGagpxdORQZaVUu2MNTgOPL8BiGE4/SlCnXAAAAAASUVORK5CYII=`
+
+// thumbSpec describes the thumbnails to make; it is part of their cache
+// key, so changing it invalidates the cache.
+type thumbSpec struct {
+	Width, Height int    // the box thumbnails are scaled down to, 0 for unbounded
+	Fit           string // "fit" in the box, or "crop" to fill it
+	Format        string // "jpeg", "png" or "webp"
+	Seek          string // where video frames are taken: "10%" or "hh:mm:ss"
+}
+
+const maxThumbSize = 2048
+
+var defaultThumbSpec = thumbSpec{Width: 320, Height: 320, Fit: "fit", Format: "jpeg", Seek: "10%"}
+
+func (s thumbSpec) String() string {
+	return fmt.Sprintf("%dx%d %s %s %s", s.Width, s.Height, s.Fit, s.Format, s.Seek)
+}
+
+// check reports whether s describes thumbnails that can be made.
+func (s thumbSpec) check() error {
+	if s.Width < 0 || s.Height < 0 || s.Width > maxThumbSize || s.Height > maxThumbSize {
+		return fmt.Errorf("thumbnail size must be at most %dx%d", maxThumbSize, maxThumbSize)
+	}
+	switch s.Fit {
+	case "fit", "crop":
+	default:
+		return fmt.Errorf("unknown thumbnail fit %q", s.Fit)
+	}
+	switch s.Format {
+	case "jpeg", "png", "webp":
+	default:
+		return fmt.Errorf("unknown thumbnail format %q", s.Format)
+	}
+	return nil
+}
+
+// parseThumbSpec returns the thumbnail spec of a ?thumb=true request: the
+// defaults, overridden by any of the w, h, fit, format and t parameters.
+func parseThumbSpec(r *http.Request, defaults thumbSpec) (thumbSpec, error) {
+	query := r.URL.Query()
+	s := defaults
+	for key, size := range map[string]*int{"w": &s.Width, "h": &s.Height} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return s, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*size = n
+		}
+	}
+	if v := query.Get("fit"); v != "" {
+		s.Fit = v
+	}
+	if v := query.Get("format"); v != "" {
+		s.Format = v
+	}
+	if v := query.Get("t"); v != "" {
+		seek, err := parseSeek(v)
+		if err != nil {
+			return s, err
+		}
+		s.Seek = seek
+	}
+	return s, s.check()
+}
+
+// parseSeek parses a position in a video, as a percentage ("25%"), in
+// seconds ("90") or as [hh:]mm:ss, into the form ffmpegthumbnailer takes.
+func parseSeek(t string) (string, error) {
+	if p, ok := strings.CutSuffix(t, "%"); ok {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 100 {
+			return "", fmt.Errorf("invalid seek percentage %q", t)
+		}
+		return strconv.Itoa(n) + "%", nil
+	}
+	secs := 0.0
+	for _, part := range strings.Split(t, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		// Written so NaN fails too; the bound keeps secs within an int.
+		if err != nil || !(v >= 0 && v < 1e9) || strings.Count(t, ":") > 2 {
+			return "", fmt.Errorf("invalid seek position %q", t)
+		}
+		secs = secs*60 + v
+	}
+	n := int(secs)
+	return fmt.Sprintf("%02d:%02d:%02d", n/3600, n/60%60, n%60), nil
+}
+
+// A thumbnailer makes a thumbnail of the file name in fsys as spec says,
+// giving up when ctx is done.
+type thumbnailer func(ctx context.Context, fsys FileSystem, name string, spec thumbSpec) ([]byte, error)
+
+// thumbnailers maps MIME types to the thumbnailer for them. A type ending
+// in "/" covers every subtype. More types are supported by adding them.
+var thumbnailers = map[string]thumbnailer{
+	"image/jpeg": imageThumb,
+	"image/png":  imageThumb,
+	"image/gif":  imageThumb,
+	"image/webp": imageThumb,
+	"video/":     videoThumb,
+}
+
+var errNoThumbnailer = errors.New("no thumbnailer for this type")
+
+// thumbnailerFor returns the thumbnailer for files of type ctype.
+func thumbnailerFor(ctype string) (thumbnailer, error) {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	ctype = strings.TrimSpace(ctype)
+	if t, ok := thumbnailers[ctype]; ok {
+		return t, nil
+	}
+	if major, _, ok := strings.Cut(ctype, "/"); ok {
+		if t, ok := thumbnailers[major+"/"]; ok {
+			return t, nil
+		}
+	}
+	return nil, errNoThumbnailer
+}
+
+// serveThumb replies with a thumbnail of the file name, or with FileImg
+// if one can't be generated. Thumbnails are cached in h.thumbs, and carry
+// an ETag and the file's modification time so browsers can revalidate
+// them; with a ?v= matching thumbVersion, they are cached for good.
+func (h *fileHandler) serveThumb(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	defaults := h.thumbSpec
+	if defaults == (thumbSpec{}) {
+		defaults = defaultThumbSpec
+	}
+	spec, err := parseThumbSpec(r, defaults)
+	if err != nil {
+		http.Error(w, "invalid thumbnail: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctype := ""
+	if !info.IsDir() {
+		ctype = h.fileType(name)
+	}
+	key := thumbKey(h.thumbID(name), info, ctype+" "+spec.String())
+	body, err := h.cachedThumb(r, key, func(ctx context.Context) ([]byte, error) {
+		makeThumb, err := thumbnailerFor(ctype)
+		if err != nil {
+			return nil, err
+		}
+		return makeThumb(ctx, h.root, name, spec)
+	})
+	switch {
+	case errors.Is(err, errThumbQueueFull):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case r.Context().Err() != nil:
+		return
+	}
+
+	if len(body) == 0 {
+		fimg, _ := base64.StdEncoding.DecodeString(FileImg)
+		if isTransient(err) {
+			// Maybe timed out; try again next time.
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(fimg))
+		return
+	}
+	setThumbCaching(w, r, key, info)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(body))
+}
+
+// cachedThumb returns the thumbnail cached in h.thumbs under key, or makes
+// it with fn on h.thumbPool and caches it. Failures are cached as empty
+// thumbnails so they aren't retried until the file changes, unless fn gave
+// up because no request waits for it any more or a program is missing.
+// Running out of time counts as a failure: the timeout only starts once a
+// worker runs fn, so it would run out again.
+func (h *fileHandler) cachedThumb(r *http.Request, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	return h.cachedThumbWithin(r, key, 0, fn)
+}
+
+// cachedThumbWithin is cachedThumb giving fn timeout rather than the
+// timeout of h.thumbPool, if positive.
+func (h *fileHandler) cachedThumbWithin(r *http.Request, key string, timeout time.Duration, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if body, ok := h.thumbs.get(key); ok {
+		return body, nil
+	}
+	return h.thumbPool.do(r.Context(), key, timeout, func(ctx context.Context) ([]byte, error) {
+		body, err := fn(ctx)
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled), errors.Is(err, exec.ErrNotFound):
+		case err != nil:
+			h.thumbs.put(key, nil)
+		default:
+			h.thumbs.put(key, body)
+		}
+		return body, err
+	})
+}
+
+// isTransient reports whether cachedThumb failed with err for a reason
+// that may go away, so the failure mustn't be cached by browsers either.
+func isTransient(err error) bool {
+	return err != nil && !errors.Is(err, exec.ErrNotFound) && !errors.Is(err, errNoThumbnailer)
+}
+
+// setThumbCaching sets the ETag and Cache-Control of a thumbnail with the
+// given key of the file with info: with a ?v= matching thumbVersion,
+// browsers may cache it for good.
+func setThumbCaching(w http.ResponseWriter, r *http.Request, key string, info fs.FileInfo) {
+	w.Header().Set("ETag", `"`+key+`"`)
+	if v := r.URL.Query().Get("v"); v != "" && v == thumbVersion(info) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+}
+
+// thumbID returns what identifies the file name in thumbnail cache keys:
+// its host path for a Dir root, so servers of different directories can
+// share a cache.
+func (h *fileHandler) thumbID(name string) string {
+	if d, ok := h.root.(Dir); ok {
+		if p, err := d.hostPath(name); err == nil {
+			return p
+		}
+	}
+	return name
+}
+
+// thumbVersion changes whenever the thumbnail of a file with info would,
+// so listings can put it in thumbnail URLs that browsers cache for good.
+func thumbVersion(info fs.FileInfo) string {
+	return strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36)
+}
+
+// videoThumb takes a frame at spec.Seek with ffmpegthumbnailer, killing
+// it when ctx is done, and makes the thumbnail of it.
+func videoThumb(ctx context.Context, fsys FileSystem, name string, spec thumbSpec) ([]byte, error) {
+	filePath, cleanup, err := localPath(fsys, name)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	// ffmpegthumbnailer scales the longer side to -s; a crop needs
+	// more of the frame.
+	size := max(spec.Width, spec.Height)
+	if spec.Fit == "crop" {
+		size *= 2
+	}
+	if spec.Width == 0 || spec.Height == 0 {
+		size = 0
+	}
+	frame, err := videoFrame(ctx, filePath, size, spec.Seek)
+	if err != nil {
+		return nil, err
+	}
+	return resizeThumb(frame, spec, 1)
+}
+
+// videoFrame returns the frame at seek, as parseSeek returns it, of the
+// video at filePath with ffmpegthumbnailer, its longer side scaled to size
+// unless that is 0.
+func videoFrame(ctx context.Context, filePath string, size int, seek string) (image.Image, error) {
+	args := []string{}
+	args = append(args, "-s", strconv.Itoa(size))
+	args = append(args, "-t", seek)
+
+	args = append(args, "-i", filePath, "-o", "/dev/stdout", "-c", "png")
+	cmd := exec.CommandContext(ctx, "ffmpegthumbnailer", args...)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
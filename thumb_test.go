@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestThumbnailerFor(t *testing.T) {
+	for _, ctype := range []string{"image/jpeg", "image/png", "image/gif", "image/webp", "video/mp4", "video/x-matroska", "video/webm; codecs=vp9"} {
+		if _, err := thumbnailerFor(ctype); err != nil {
+			t.Errorf("%s: %v", ctype, err)
+		}
+	}
+	for _, ctype := range []string{"", "application/octet-stream", "application/zip", "text/plain; charset=utf-8", "image/svg+xml", "audio/mpeg"} {
+		if _, err := thumbnailerFor(ctype); !errors.Is(err, errNoThumbnailer) {
+			t.Errorf("%s: got %v, want %v", ctype, err, errNoThumbnailer)
+		}
+	}
+}
+
+func TestParseSeek(t *testing.T) {
+	for in, want := range map[string]string{
+		"0%":        "0%",
+		"25%":       "25%",
+		"100%":      "100%",
+		"0":         "00:00:00",
+		"90":        "00:01:30",
+		"1.9":       "00:00:01",
+		"1:30":      "00:01:30",
+		"01:02:03":  "01:02:03",
+		"0:90":      "00:01:30",
+		"100:00:00": "100:00:00",
+	} {
+		if got, err := parseSeek(in); err != nil || got != want {
+			t.Errorf("parseSeek(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "%", "-1%", "101%", "2.5%", "-1", "1:-1", "1:2:3:4", "1::2", "abc", "NaN", "Inf", "1e300", "0:NaN"} {
+		if got, err := parseSeek(in); err == nil {
+			t.Errorf("parseSeek(%q) = %q, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// thumbCache keeps generated thumbnails in dir, named by thumbKey, and
+// removes the least recently used ones once they take more than max bytes.
+// An empty file records that no thumbnail could be made, so files that
+// aren't images or videos don't fork a thumbnailer on every listing.
+type thumbCache struct {
+	dir string
+	max int64 // 0 for no limit
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// defaultThumbCache returns the default cache directory, under the user's
+// cache directory, or "" if there is none.
+func defaultThumbCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "browsile", "thumbs")
+}
+
+// newThumbCache opens the cache in dir, creating it if needed, and picks up
+// the thumbnails of previous runs in order of last use.
+func newThumbCache(dir string, maxSize int64) (*thumbCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &thumbCache{dir: dir, max: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+
+	type found struct {
+		key  string
+		size int64
+		used time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if filepath.Base(filepath.Dir(p)) == "tmp" {
+			// Left over from a crash.
+			os.Remove(p)
+			return nil
+		}
+		files = append(files, found{de.Name(), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.After(files[j].used) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushBack(&cacheEntry{f.key, diskSize(f.size)})
+		c.size += diskSize(f.size)
+	}
+	c.evict()
+	return c, nil
+}
+
+// thumbKey identifies the thumbnail of the file at name, as it is now, made
+// with params. It doubles as the thumbnail's ETag.
+func thumbKey(name string, info fs.FileInfo, params string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%s", name, info.ModTime().UnixNano(), info.Size(), params)))
+	return hex.EncodeToString(sum[:])
+}
+
+// diskSize is roughly the space a file of n bytes takes, so that empty
+// entries count too.
+func diskSize(n int64) int64 {
+	return max(4096, (n+4095)&^4095)
+}
+
+func (c *thumbCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the cached thumbnail for key; an empty one if it is known
+// that none can be made.
+func (c *thumbCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	p := c.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	// The modification time records the last use for the next run.
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// put stores the thumbnail for key.
+func (c *thumbCache) put(key string, data []byte) {
+	if c == nil {
+		return
+	}
+	if err := c.write(key, data); err != nil {
+		log.Println("thumbnail cache:", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, diskSize(int64(len(data)))})
+	c.size += diskSize(int64(len(data)))
+	c.evict()
+}
+
+// write writes the file for key atomically, so a concurrent get never
+// reads half a thumbnail.
+func (c *thumbCache) write(key string, data []byte) error {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tmpDir, key)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.path(key)), 0o700)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (c *thumbCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// evict removes least recently used thumbnails until the cache fits in
+// c.max; c.mu must be held.
+func (c *thumbCache) evict() {
+	for c.max > 0 && c.size > c.max && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		ce := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, ce.key)
+		c.size -= ce.size
+		os.Remove(c.path(ce.key))
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImagePixels bounds the size of images imageThumb decodes, as decoding
+// takes four bytes or more per pixel.
+const maxImagePixels = 100 << 20
+
+// imageThumb makes thumbnails of still images in Go, without running
+// anything: it decodes the image and passes it to resizeThumb with its
+// EXIF orientation.
+func imageThumb(ctx context.Context, fsys FileSystem, name string, spec thumbSpec) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errors.New("image too large for a thumbnail")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	orientation := exifOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return resizeThumb(src, spec, orientation)
+}
+
+// resizeThumb scales src down to the box of spec, cropping it to fill the
+// box if spec.Fit says so, turns it upright as the EXIF orientation says
+// and encodes it as spec.Format.
+func resizeThumb(src image.Image, spec thumbSpec, orientation int) ([]byte, error) {
+	// Orientations 5 to 8 swap width and height.
+	w, h := spec.Width, spec.Height
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	b := src.Bounds()
+	var dst *image.NRGBA
+	if spec.Fit == "crop" && w > 0 && h > 0 {
+		// Scale to cover the box, then take the middle of it.
+		scale := max(float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy()))
+		cw, ch := min(b.Dx(), int(float64(w)/scale+0.5)), min(b.Dy(), int(float64(h)/scale+0.5))
+		crop := image.Rect(0, 0, max(cw, 1), max(ch, 1)).Add(b.Min).Add(image.Pt((b.Dx()-cw)/2, (b.Dy()-ch)/2))
+		tw, th := w, h
+		if scale >= 1 {
+			// Too small to scale down: crop to the box only.
+			tw, th = crop.Dx(), crop.Dy()
+		}
+		dst = image.NewNRGBA(image.Rect(0, 0, tw, th))
+		draw.CatmullRom.Scale(dst, dst.Rect, src, crop, draw.Src, nil)
+	} else {
+		tw, th := fitSize(b.Dx(), b.Dy(), w, h)
+		dst = image.NewNRGBA(image.Rect(0, 0, tw, th))
+		draw.CatmullRom.Scale(dst, dst.Rect, src, b, draw.Src, nil)
+	}
+	return encodeThumb(orient(dst, orientation), spec.Format)
+}
+
+// fitSize returns the size of a w×h image scaled down to fit in maxW×maxH,
+// keeping its aspect ratio. Images never get larger, and a max of 0 leaves
+// that side unbounded.
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	return max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+}
+
+// encodeThumb encodes img as a "jpeg", "png" or "webp" image.
+func encodeThumb(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		err = encodeWebP(&buf, img)
+	default:
+		// JPEG has no alpha: put transparent images on white.
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Rect, image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Rect, img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+// orient returns img turned as EXIF orientation o says it must be to be
+// upright.
+func orient(img *image.NRGBA, o int) *image.NRGBA {
+	if o < 2 || o > 8 {
+		return img
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the EXIF orientation, 1 to 8, of a JPEG or WebP
+// image, or 1 if it has none.
+func exifOrientation(r io.Reader) int {
+	head := make([]byte, 256<<10)
+	n, _ := io.ReadFull(r, head)
+	head = head[:n]
+	var exif []byte
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8}):
+		// JPEG: look for an APP1 segment holding Exif data before the
+		// image data starts.
+		for p := 2; p+4 <= len(head) && head[p] == 0xff; {
+			marker := head[p+1]
+			size := int(binary.BigEndian.Uint16(head[p+2:]))
+			if marker == 0xda || p+2+size > len(head) {
+				break
+			}
+			if seg := head[p+4 : p+2+size]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				exif = seg[6:]
+				break
+			}
+			p += 2 + size
+		}
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		// WebP: look for an EXIF chunk.
+		for p := 12; p+8 <= len(head); {
+			size := int(binary.LittleEndian.Uint32(head[p+4:]))
+			if size < 0 || p+8+size > len(head) {
+				break
+			}
+			if string(head[p:p+4]) == "EXIF" {
+				exif = bytes.TrimPrefix(head[p+8:p+8+size], []byte("Exif\x00\x00"))
+				break
+			}
+			p += 8 + size + size&1
+		}
+	}
+	return tiffOrientation(exif)
+}
+
+// tiffOrientation returns the Orientation tag of the first IFD of the TIFF
+// structure in exif, or 1.
+func tiffOrientation(exif []byte) int {
+	if len(exif) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return 1
+	}
+	n := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[e:]) == 0x0112 {
+			if o := int(order.Uint16(exif[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
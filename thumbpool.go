@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errThumbQueueFull is returned by thumbPool.do when too many thumbnails
+// are waiting to be made.
+var errThumbQueueFull = errors.New("too many thumbnails queued")
+
+// thumbPool makes thumbnails on a fixed number of workers. Jobs wait in a
+// bounded queue, run with a timeout that starts when a worker picks them
+// up, and are shared by every request for the same thumbnail; a job is
+// cancelled once no request waits for it.
+type thumbPool struct {
+	queue   chan *thumbJob
+	timeout time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*thumbJob // queued or running, by key
+}
+
+type thumbJob struct {
+	key     string
+	fn      func(ctx context.Context) ([]byte, error)
+	timeout time.Duration
+	ctx     context.Context // cancelled when no request waits any more
+	cancel  context.CancelFunc
+	waiters int // guarded by thumbPool.mu
+
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// newThumbPool starts workers that make thumbnails, each taking at most
+// timeout, with up to queue more waiting.
+func newThumbPool(workers, queue int, timeout time.Duration) *thumbPool {
+	p := &thumbPool{
+		queue:   make(chan *thumbJob, queue),
+		timeout: timeout,
+		jobs:    map[string]*thumbJob{},
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *thumbPool) work() {
+	for job := range p.queue {
+		if job.err = job.ctx.Err(); job.err == nil {
+			ctx, cancel := context.WithTimeout(job.ctx, job.timeout)
+			job.body, job.err = job.fn(ctx)
+			cancel()
+		}
+		job.cancel()
+		p.mu.Lock()
+		if p.jobs[job.key] == job {
+			delete(p.jobs, job.key)
+		}
+		p.mu.Unlock()
+		close(job.done)
+	}
+}
+
+// do returns the result of fn, run on a worker for at most timeout, or
+// the timeout of the pool if 0, or joins a queued or running job with the
+// same key. It returns early with the error of ctx when ctx is done.
+func (p *thumbPool) do(ctx context.Context, key string, timeout time.Duration, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if p == nil {
+		return fn(ctx)
+	}
+	p.mu.Lock()
+	job := p.jobs[key]
+	if job == nil {
+		if timeout <= 0 {
+			timeout = p.timeout
+		}
+		job = &thumbJob{key: key, fn: fn, timeout: timeout, done: make(chan struct{})}
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		select {
+		case p.queue <- job:
+			p.jobs[key] = job
+		default:
+			p.mu.Unlock()
+			job.cancel()
+			return nil, errThumbQueueFull
+		}
+	}
+	job.waiters++
+	p.mu.Unlock()
+
+	select {
+	case <-job.done:
+		return job.body, job.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		if job.waiters--; job.waiters == 0 {
+			// Nobody wants it any more: stop it, or skip it if still
+			// queued.
+			job.cancel()
+			if p.jobs[key] == job {
+				delete(p.jobs, key)
+			}
+		}
+		p.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
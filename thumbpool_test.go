@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sleepJob returns a job that takes d unless its context ends first.
+func sleepJob(d time.Duration) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		select {
+		case <-time.After(d):
+			return []byte("ok"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestThumbPoolTimeoutStartsOnWorker(t *testing.T) {
+	p := newThumbPool(1, 10, 200*time.Millisecond)
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Together they take longer than the timeout, but each
+			// is well within it.
+			_, errs[i] = p.do(context.Background(), string(rune('a'+i)), 0, sleepJob(100*time.Millisecond))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("job %d: %v", i, err)
+		}
+	}
+
+	if _, err := p.do(context.Background(), "slow", 0, sleepJob(time.Second)); err != context.DeadlineExceeded {
+		t.Errorf("slow job: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := p.do(context.Background(), "own", 2*time.Second, sleepJob(time.Second)); err != nil {
+		t.Errorf("job with its own timeout: %v", err)
+	}
+}
+
+func TestThumbPoolShareAndCancel(t *testing.T) {
+	p := newThumbPool(1, 10, time.Minute)
+	var mu sync.Mutex
+	runs := 0
+	fn := func(ctx context.Context) ([]byte, error) {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		return sleepJob(50 * time.Millisecond)(ctx)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, err := p.do(context.Background(), "k", 0, fn); err != nil || string(body) != "ok" {
+				t.Errorf("got %q, %v", body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runs != 1 {
+		t.Errorf("shared job ran %d times", runs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.do(ctx, "gone", 0, sleepJob(time.Minute)); err != context.DeadlineExceeded {
+		t.Errorf("waiter gone: got %v", err)
+	}
+	// The abandoned job is cancelled, freeing the only worker.
+	if _, err := p.do(context.Background(), "next", 0, sleepJob(0)); err != nil {
+		t.Errorf("after abandoned job: %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// This file implements the core of the tus 1.0 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) with the creation,
+// expiration and termination extensions. Uploads are created by POSTing to
+// a directory URL with ?tus; the returned Location, "<dir>/?tus=<id>",
+// then takes HEAD and PATCH requests until all bytes have arrived, at
+// which point the file is moved into the directory.
+
+const tusVersion = "1.0.0"
+
+// tusStore keeps the state of unfinished uploads in dir: "<id>.bin" holds
+// the bytes received so far and "<id>.json" the tusInfo. Uploads that see
+// no PATCH for expire are removed.
+type tusStore struct {
+	dir    string
+	expire time.Duration
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// tusInfo is what a tus upload was created with.
+type tusInfo struct {
+	Dir      string `json:"dir"` // URL path of the target directory
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+}
+
+// newTusStore creates the staging directory dir and starts removing
+// expired uploads from it in the background.
+func newTusStore(dir string, expire time.Duration) (*tusStore, error) {
+	if expire <= 0 {
+		return nil, errors.New("expiry must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	t := &tusStore{dir: dir, expire: expire, busy: map[string]bool{}}
+	go func() {
+		for {
+			t.removeExpired()
+			time.Sleep(expire / 4)
+		}
+	}()
+	return t, nil
+}
+
+// defaultTusDir returns the default staging directory for a Dir root: a
+// hidden sibling of the root, so partial uploads are never served. A file
+// system root has no sibling outside it, so the staging directory must
+// then be given with -tus-dir.
+func defaultTusDir(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		abs = filepath.Clean(root)
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return "", fmt.Errorf("no default staging directory outside %s; set one with -tus-dir", abs)
+	}
+	return filepath.Join(parent, "."+filepath.Base(abs)+".tus"), nil
+}
+
+func (t *tusStore) removeExpired() {
+	list, err := os.ReadDir(t.dir)
+	if err != nil {
+		log.Println("tus:", err)
+		return
+	}
+	for _, de := range list {
+		id, ok := strings.CutSuffix(de.Name(), ".bin")
+		if !ok {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil || time.Since(info.ModTime()) < t.expire {
+			continue
+		}
+		if t.lock(id) {
+			t.remove(id)
+			t.unlock(id)
+		}
+	}
+}
+
+// lock marks upload id as in use, reporting false if it already is.
+func (t *tusStore) lock(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+func (t *tusStore) unlock(id string) {
+	t.mu.Lock()
+	delete(t.busy, id)
+	t.mu.Unlock()
+}
+
+func (t *tusStore) data(id string) string { return filepath.Join(t.dir, id+".bin") }
+
+func (t *tusStore) remove(id string) {
+	os.Remove(t.data(id))
+	os.Remove(filepath.Join(t.dir, id+".json"))
+}
+
+func (t *tusStore) info(id string) (*tusInfo, error) {
+	b, err := os.ReadFile(filepath.Join(t.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	info := new(tusInfo)
+	return info, json.Unmarshal(b, info)
+}
+
+// offset returns how many bytes of upload id have been received and when
+// it will expire.
+func (t *tusStore) offset(id string) (int64, time.Time, error) {
+	fi, err := os.Stat(t.data(id))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime().Add(t.expire), nil
+}
+
+func (t *tusStore) create(info *tusInfo) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, id+".json"), meta, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(t.data(id), nil, 0o600); err != nil {
+		t.remove(id)
+		return "", err
+	}
+	return id, nil
+}
+
+// validTusID reports whether id looks like one made by create, so it can
+// be used as a file name in the staging directory.
+func validTusID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+// serveTus handles tus requests for the directory name.
+func (h *fileHandler) serveTus(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		if h.uploadMax > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.uploadMax, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if _, ok := h.root.(Dir); !ok {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("tus")
+	if id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.tusCreate(w, r, name)
+		return
+	}
+	if !validTusID(id) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		offset, expires, err := h.tus.offset(id)
+		info, ierr := h.tus.info(id)
+		if err != nil || ierr != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		h.tusPatch(w, r, id)
+	case "DELETE":
+		if !h.tus.lock(id) {
+			http.Error(w, "upload in progress", http.StatusConflict)
+			return
+		}
+		defer h.tus.unlock(id)
+		if _, err := h.tus.info(id); err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		h.tus.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *fileHandler) tusCreate(w http.ResponseWriter, r *http.Request, name string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if h.uploadMax > 0 && length > h.uploadMax {
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	filename, ok := sanitizeName(tusMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+	if !ok {
+		http.Error(w, "invalid filename in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	dirPath, err := h.root.(Dir).hostPath(name)
+	if err == nil {
+		err = checkDir(dirPath)
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	id, err := h.tus.create(&tusInfo{Dir: name, Filename: filename, Length: length})
+	if err != nil {
+		log.Println("tus:", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if length == 0 {
+		if err := h.tusFinish(id); err != nil {
+			uploadError(w, err)
+			return
+		}
+	}
+	dirURL := url.URL{Path: strings.TrimSuffix(name, "/") + "/", RawQuery: "tus=" + id}
+	w.Header().Set("Location", dirURL.String())
+	if _, expires, err := h.tus.offset(id); err == nil {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *fileHandler) tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !h.tus.lock(id) {
+		http.Error(w, "upload in progress", http.StatusConflict)
+		return
+	}
+	defer h.tus.unlock(id)
+
+	info, err := h.tus.info(id)
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	offset, _, err := h.tus.offset(id)
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		http.Error(w, "mismatched Upload-Offset", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(h.tus.data(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	// Keep whatever arrived before the connection dropped; the client
+	// resumes from the offset it gets with HEAD.
+	n, err := io.Copy(f, io.LimitReader(r.Body, info.Length-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += n
+	if err != nil {
+		log.Println("tus:", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if offset == info.Length {
+		if err := h.tusFinish(id); err != nil {
+			uploadError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if _, expires, err := h.tus.offset(id); err == nil {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusFinish moves the completed upload id to its target directory,
+// applying the upload conflict policy.
+func (h *fileHandler) tusFinish(id string) error {
+	info, err := h.tus.info(id)
+	if err != nil {
+		return err
+	}
+	dirPath, err := h.root.(Dir).hostPath(info.Dir)
+	if err != nil {
+		return err
+	}
+	if err := checkDir(dirPath); err != nil {
+		return err
+	}
+	dst := filepath.Join(dirPath, info.Filename)
+	if err := os.Chmod(h.tus.data(id), 0o644); err != nil {
+		return err
+	}
+	_, err = commitUpload(h.tus.data(id), dst, h.uploadConflict)
+	if errors.Is(err, syscall.EXDEV) {
+		// The staging directory is on another file system.
+		var f *os.File
+		if f, err = os.Open(h.tus.data(id)); err == nil {
+			_, err = h.storeUpload(f, dst)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	h.tus.remove(id)
+	log.Println("tus: stored", path.Join(info.Dir, info.Filename))
+	return nil
+}
+
+// tusMetadata decodes an Upload-Metadata header.
+func tusMetadata(s string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(b)
+	}
+	return meta
+}
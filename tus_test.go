@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTusServer returns a fileHandler with tus uploads into a temporary
+// directory, and that directory.
+func newTusServer(t *testing.T, conflict string) (*fileHandler, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tus, err := newTusStore(filepath.Join(t.TempDir(), "tus"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fileHandler{root: Dir(dir), upload: true, uploadConflict: conflict, tus: tus}, dir
+}
+
+// tusDo sends a tus request to h and returns the response.
+func tusDo(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func tusFilename(name string) string {
+	return "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+}
+
+func TestTusUpload(t *testing.T) {
+	h, dir := newTusServer(t, conflictReject)
+	w := tusDo(h, "POST", "/sub?tus", "", "Upload-Length", "11", "Upload-Metadata", tusFilename("hello.txt"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", w.Code, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	if !strings.HasPrefix(loc, "/sub/?tus=") || !validTusID(strings.TrimPrefix(loc, "/sub/?tus=")) {
+		t.Fatalf("Location %q", loc)
+	}
+
+	const octets = "application/offset+octet-stream"
+	if w := tusDo(h, "PATCH", loc, "hello", "Upload-Offset", "0", "Content-Type", "text/plain"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH of text/plain: got %d", w.Code)
+	}
+	if w := tusDo(h, "PATCH", loc, "hello", "Upload-Offset", "0", "Content-Type", octets); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first PATCH: got %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := tusDo(h, "PATCH", loc, " world", "Upload-Offset", "0", "Content-Type", octets); w.Code != http.StatusConflict {
+		t.Errorf("PATCH at a stale offset: got %d", w.Code)
+	}
+	w = tusDo(h, "HEAD", loc, "")
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "11" {
+		t.Errorf("HEAD: got %d, offset %q, length %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "hello.txt")); !os.IsNotExist(err) {
+		t.Errorf("unfinished upload is already in place: %v", err)
+	}
+
+	// Bytes past Upload-Length are not stored.
+	if w := tusDo(h, "PATCH", loc, " world and more", "Upload-Offset", "5", "Content-Type", octets); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("last PATCH: got %d, offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "sub", "hello.txt")); err != nil || string(b) != "hello world" {
+		t.Errorf("stored %q, %v", b, err)
+	}
+	if w := tusDo(h, "HEAD", loc, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of finished upload: got %d", w.Code)
+	}
+
+	w = tusDo(h, "POST", "/sub?tus", "", "Upload-Length", "0", "Upload-Metadata", tusFilename("hello.txt"))
+	if w.Code != http.StatusConflict {
+		t.Errorf("empty upload over an existing file with -upload-conflict reject: got %d", w.Code)
+	}
+}
+
+func TestTusEmptyAndDelete(t *testing.T) {
+	h, dir := newTusServer(t, conflictRename)
+	if w := tusDo(h, "POST", "/?tus", "", "Upload-Length", "0", "Upload-Metadata", tusFilename("empty")); w.Code != http.StatusCreated {
+		t.Fatalf("empty upload: got %d", w.Code)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "empty")); err != nil || fi.Size() != 0 {
+		t.Errorf("empty upload not stored: %v", err)
+	}
+
+	w := tusDo(h, "POST", "/?tus", "", "Upload-Length", "3", "Upload-Metadata", tusFilename("gone"))
+	loc := w.Header().Get("Location")
+	if w := tusDo(h, "DELETE", loc, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", w.Code)
+	}
+	if w := tusDo(h, "DELETE", loc, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: got %d", w.Code)
+	}
+	if list, _ := os.ReadDir(h.tus.dir); len(list) != 0 {
+		t.Errorf("staging directory holds %d files after DELETE", len(list))
+	}
+}
+
+func TestTusErrors(t *testing.T) {
+	h, _ := newTusServer(t, conflictRename)
+	h.uploadMax = 10
+	name := tusFilename("a")
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header []string
+		want   int
+	}{
+		{"no length", "POST", "/?tus", []string{"Upload-Metadata", name}, http.StatusBadRequest},
+		{"negative length", "POST", "/?tus", []string{"Upload-Length", "-1", "Upload-Metadata", name}, http.StatusBadRequest},
+		{"too long", "POST", "/?tus", []string{"Upload-Length", "11", "Upload-Metadata", name}, http.StatusRequestEntityTooLarge},
+		{"no filename", "POST", "/?tus", []string{"Upload-Length", "1"}, http.StatusBadRequest},
+		{"bad filename", "POST", "/?tus", []string{"Upload-Length", "1", "Upload-Metadata", tusFilename("../a")}, http.StatusBadRequest},
+		{"missing directory", "POST", "/nope?tus", []string{"Upload-Length", "1", "Upload-Metadata", name}, http.StatusNotFound},
+		{"wrong version", "POST", "/?tus", []string{"Tus-Resumable", "0.2.2", "Upload-Length", "1", "Upload-Metadata", name}, http.StatusPreconditionFailed},
+		{"PATCH without id", "PATCH", "/?tus", nil, http.StatusMethodNotAllowed},
+		{"bad id", "HEAD", "/?tus=../../etc/passwd", nil, http.StatusNotFound},
+		{"unknown id", "HEAD", "/?tus=" + strings.Repeat("ab", 16), nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := tusDo(h, tt.method, tt.target, "", tt.header...); w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	w := tusDo(h, "OPTIONS", "/?tus", "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != tusVersion || w.Header().Get("Tus-Max-Size") != "10" {
+		t.Errorf("OPTIONS: got %d, %v", w.Code, w.Header())
+	}
+}
+
+func TestTusMetadata(t *testing.T) {
+	got := tusMetadata("filename " + base64.StdEncoding.EncodeToString([]byte("a b,c.txt")) +
+		", is_confidential,  type dGV4dC9wbGFpbg== , bad !!!")
+	want := map[string]string{"filename": "a b,c.txt", "is_confidential": "", "type": "text/plain"}
+	if len(got) != len(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if got := tusMetadata(""); len(got) != 0 {
+		t.Errorf("empty header: got %q", got)
+	}
+}
+
+func TestValidTusID(t *testing.T) {
+	for id, want := range map[string]bool{
+		strings.Repeat("0f", 16):        true,
+		strings.Repeat("0F", 16):        true,
+		strings.Repeat("0f", 15):        false,
+		strings.Repeat("0f", 17):        false,
+		strings.Repeat("zz", 16):        false,
+		"../" + strings.Repeat("0", 29): false,
+		"":                              false,
+	} {
+		if got := validTusID(id); got != want {
+			t.Errorf("validTusID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestDefaultTusDir(t *testing.T) {
+	for root, want := range map[string]string{
+		"/srv/files":  "/srv/.files.tus",
+		"/srv/files/": "/srv/.files.tus",
+		"/srv":        "/.srv.tus",
+	} {
+		if got, err := defaultTusDir(root); err != nil || got != want {
+			t.Errorf("defaultTusDir(%q) = %q, %v, want %q", root, got, err, want)
+		}
+	}
+	if got, err := defaultTusDir("/"); err == nil {
+		t.Errorf("defaultTusDir(\"/\") = %q inside the root", got)
+	}
+	if got, err := defaultTusDir("/.."); err == nil {
+		t.Errorf("defaultTusDir(\"/..\") = %q inside the root", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Upload conflict policies, chosen with -upload-conflict.
+const (
+	conflictRename    = "rename"    // store as "name (1).ext"
+	conflictOverwrite = "overwrite" // replace the existing file
+	conflictReject    = "reject"    // fail with 409 Conflict
+)
+
+var errUploadExists = errors.New("file already exists")
+
+// serveUpload stores files sent as a multipart POST to a directory, or as the
+// raw body of a PUT to a file path. name is the cleaned URL path.
+func (h *fileHandler) serveUpload(w http.ResponseWriter, r *http.Request, name string) {
+	dir, ok := h.root.(Dir)
+	if !ok {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if containsDotDot(r.URL.Path) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if h.uploadMax > 0 {
+		if r.ContentLength > h.uploadMax {
+			http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.uploadMax)
+	}
+
+	if r.Method == "PUT" {
+		h.servePut(w, r, dir, name)
+		return
+	}
+
+	dirPath, err := dir.hostPath(name)
+	if err == nil {
+		err = checkDir(dirPath)
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+	var saved []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		fname, ok := sanitizeName(part.FileName())
+		if !ok {
+			part.Close()
+			http.Error(w, "invalid file name", http.StatusBadRequest)
+			return
+		}
+		final, err := h.storeUpload(part, filepath.Join(dirPath, fname))
+		part.Close()
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		saved = append(saved, filepath.Base(final))
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		// A plain form submission; show the updated directory.
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	for _, s := range saved {
+		fmt.Fprintln(w, s)
+	}
+}
+
+func (h *fileHandler) servePut(w http.ResponseWriter, r *http.Request, dir Dir, name string) {
+	if strings.HasSuffix(r.URL.Path, "/") || name == "/" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := sanitizeName(path.Base(name)); !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	dst, err := dir.hostPath(name)
+	if err == nil {
+		err = checkDir(filepath.Dir(dst))
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	existed := false
+	if fi, err := os.Stat(dst); err == nil {
+		if fi.IsDir() {
+			http.Error(w, "409 Conflict", http.StatusConflict)
+			return
+		}
+		existed = true
+	}
+
+	final, err := h.storeUpload(r.Body, dst)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	if existed && final == dst {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", path.Join(path.Dir(r.URL.Path), filepath.Base(final)))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// storeUpload writes src to a temporary file next to dst and then moves it
+// into place according to the conflict policy, so a partial upload never
+// appears under its final name. It returns the name the file was stored as.
+func (h *fileHandler) storeUpload(src io.Reader, dst string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".browsile-upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		// CreateTemp makes the file private; uploads should be
+		// readable like any other file in the tree.
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		dst, err = commitUpload(tmp.Name(), dst, h.uploadConflict)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return dst, nil
+}
+
+// commitUpload moves the finished temporary file tmp to dst. Unless policy
+// is conflictOverwrite, an existing dst is never replaced: the file is hard
+// linked into place, which fails atomically if dst exists.
+func commitUpload(tmp, dst, policy string) (string, error) {
+	if policy == conflictOverwrite {
+		return dst, os.Rename(tmp, dst)
+	}
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	for i := 1; ; i++ {
+		err := os.Link(tmp, dst)
+		if err == nil {
+			os.Remove(tmp)
+			return dst, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			// Some file systems (FAT, many FUSE mounts) can't hard
+			// link; fall back to a racy check and rename.
+			if _, serr := os.Lstat(dst); errors.Is(serr, fs.ErrNotExist) {
+				return dst, os.Rename(tmp, dst)
+			} else if serr != nil {
+				return "", err
+			}
+		}
+		if policy == conflictReject {
+			return "", errUploadExists
+		}
+		dst = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// sanitizeName validates a client supplied file name, returning it without
+// surrounding white space. Names with path separators, control characters
+// or ".." elements are rejected.
+func sanitizeName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || containsDotDot(name) || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// checkDir returns fs.ErrNotExist unless p is an existing directory.
+func checkDir(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func uploadError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUploadExists):
+		http.Error(w, "409 Conflict", http.StatusConflict)
+	default:
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// newDavHandler serves the tree of fh over WebDAV under prefix. GET and
+// HEAD go to fh itself, so downloads get the same Range and conditional
+// request handling as the rest of the server. Unless write is set, only
+// the methods needed to browse and download are allowed.
+func newDavHandler(fh *fileHandler, prefix string, write bool) http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(prefix, "/"),
+		FileSystem: davFS{root: fh.root, write: write},
+		LockSystem: webdav.NewMemLS(),
+	}
+	get := http.StripPrefix(dav.Prefix, fh)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if containsDotDot(r.URL.Path) || containsDotDot(davDestination(r)) {
+			http.Error(w, "invalid URL path", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			get.ServeHTTP(w, r)
+		case "OPTIONS", "PROPFIND":
+			dav.ServeHTTP(w, r)
+		case "PUT", "MKCOL", "MOVE", "COPY", "DELETE", "PROPPATCH", "LOCK", "UNLOCK":
+			if !write {
+				w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+				http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			dav.ServeHTTP(w, r)
+		default:
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// davDestination returns the path of the Destination header of a MOVE or
+// COPY request.
+func davDestination(r *http.Request) string {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// davFS adapts a FileSystem to webdav.FileSystem. Reads go through root,
+// exactly like the file server; writes need root to be a Dir and are
+// resolved with Dir.hostPath.
+type davFS struct {
+	root  FileSystem
+	write bool
+}
+
+// davFile is a read-only webdav.File.
+type davFile struct {
+	File
+}
+
+func (davFile) Write([]byte) (int, error) { return 0, fs.ErrPermission }
+
+func (d davFS) hostPath(name string) (string, error) {
+	dir, ok := d.root.(Dir)
+	if !ok || !d.write {
+		return "", fs.ErrPermission
+	}
+	return dir.hostPath(name)
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p, err := d.hostPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		f, err := d.root.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		if wf, ok := f.(webdav.File); ok && d.write {
+			return wf, nil
+		}
+		return davFile{f}, nil
+	}
+	p, err := d.hostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		// Never let a DELETE of the prefix wipe the served tree.
+		return fs.ErrPermission
+	}
+	p, err := d.hostPath(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" {
+		return fs.ErrPermission
+	}
+	oldPath, err := d.hostPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.hostPath(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := d.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
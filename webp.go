@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math/bits"
+	"sort"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// encodeWebP writes img as a lossless WebP (VP8L) image. x/image can
+// decode WebP but not encode it, so this is a small encoder of its own: it
+// uses the subtract green and predictor transforms, one set of Huffman
+// codes and backward references only for runs, which is good enough for
+// thumbnails.
+func encodeWebP(w io.Writer, img image.Image) error {
+	data, _, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+	return writeWebP(w, riffChunk("VP8L", data))
+}
+
+// encodeAnimatedWebP writes frames, all of the same size, as an animated
+// lossless WebP that shows each for delay and loops forever.
+func encodeAnimatedWebP(w io.Writer, frames []image.Image, delay time.Duration) error {
+	if len(frames) == 0 {
+		return errors.New("webp: no frames")
+	}
+	size := frames[0].Bounds().Size()
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 // animated
+	putUint24(vp8x[4:], size.X-1)
+	putUint24(vp8x[7:], size.Y-1)
+	// A transparent background, and a loop count of 0 for forever.
+	chunks := [][]byte{nil, riffChunk("ANIM", make([]byte, 6))}
+	for _, frame := range frames {
+		if frame.Bounds().Size() != size {
+			return errors.New("webp: frames of different sizes")
+		}
+		data, alpha, err := encodeVP8L(frame)
+		if err != nil {
+			return err
+		}
+		if alpha {
+			vp8x[0] |= 0x10
+		}
+		anmf := make([]byte, 16, 16+8+len(data)+1)
+		putUint24(anmf[6:], size.X-1)
+		putUint24(anmf[9:], size.Y-1)
+		putUint24(anmf[12:], int(delay.Milliseconds()))
+		anmf[15] = 0x02 // replace the previous frame, don't blend with it
+		chunks = append(chunks, riffChunk("ANMF", append(anmf, riffChunk("VP8L", data)...)))
+	}
+	chunks[0] = riffChunk("VP8X", vp8x)
+	return writeWebP(w, chunks...)
+}
+
+// writeWebP writes a WebP file of the given chunks.
+func writeWebP(w io.Writer, chunks ...[]byte) error {
+	size := 4
+	for _, c := range chunks {
+		size += len(c)
+	}
+	head := make([]byte, 12)
+	copy(head[0:], "RIFF")
+	binary.LittleEndian.PutUint32(head[4:], uint32(size))
+	copy(head[8:], "WEBP")
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// riffChunk returns a RIFF chunk of the given type holding data, padded to
+// an even size.
+func riffChunk(fourcc string, data []byte) []byte {
+	c := make([]byte, 8, 8+len(data)+1)
+	copy(c, fourcc)
+	binary.LittleEndian.PutUint32(c[4:], uint32(len(data)))
+	c = append(c, data...)
+	if len(data)&1 != 0 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// encodeVP8L returns img as a VP8L bitstream, and whether it has
+// transparent pixels.
+func encodeVP8L(img image.Image) ([]byte, bool, error) {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return nil, false, errors.New("webp: image size out of range")
+	}
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		src = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+
+	// Red, green, blue and alpha of every pixel, with green subtracted
+	// from red and blue.
+	px := make([][4]uint8, width*height)
+	alpha := false
+	for y := 0; y < height; y++ {
+		row := src.Pix[y*src.Stride : y*src.Stride+4*width]
+		for x := 0; x < width; x++ {
+			r, g, b, a := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+			px[y*width+x] = [4]uint8{r - g, g, b - g, a}
+			alpha = alpha || a != 0xff
+		}
+	}
+	mode := bestPredictor(px, width)
+	res := predict(px, width, mode)
+	// Runs of the same residual become backward references to the pixel
+	// on the left.
+	type token struct {
+		p   [4]uint8
+		run int // if not 0, repeat the previous pixel this often instead
+	}
+	var tokens []token
+	counts := [4][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)}
+	for i := 0; i < len(res); {
+		run := 0
+		for i > 0 && i+run < len(res) && run < 4096 && res[i+run] == res[i-1] {
+			run++
+		}
+		if run >= 3 {
+			sym, _, _ := lz77Prefix(run)
+			counts[0][256+sym]++
+			tokens = append(tokens, token{run: run})
+			i += run
+			continue
+		}
+		p := res[i]
+		counts[0][p[1]]++
+		counts[1][p[0]]++
+		counts[2][p[2]]++
+		counts[3][p[3]]++
+		tokens = append(tokens, token{p: p})
+		i++
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8) // signature
+	bw.write(uint64(width-1), 14)
+	bw.write(uint64(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(1, 1) // a transform:
+	bw.write(2, 2) // subtract green
+	bw.write(1, 1) // another transform:
+	bw.write(0, 2) // predictor,
+	bw.write(7, 3) // in blocks of 1<<(7+2) pixels square,
+	// all of them using mode: the predictor image is a single color.
+	tiles := ((width + 511) / 512) * ((height + 511) / 512)
+	bw.write(0, 1) // no color cache
+	for _, sym := range []int{mode, 0, 0, 0xff, 0} {
+		c := make([]int, 256+24)
+		c[sym] = tiles
+		writeHuffCode(&bw, c)
+	}
+	bw.write(0, 1) // no more transforms
+
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // a single group of prefix codes
+	var codes [4]huffCode
+	for i := range codes {
+		codes[i] = writeHuffCode(&bw, counts[i])
+	}
+	// The only distance is to the pixel on the left, distance code 2,
+	// which is prefix symbol 1 without extra bits: a simple code of that
+	// one symbol.
+	bw.write(1, 1)
+	bw.write(0, 1)
+	bw.write(0, 1)
+	bw.write(1, 1)
+
+	for _, t := range tokens {
+		if t.run > 0 {
+			sym, n, extra := lz77Prefix(t.run)
+			codes[0].emit(&bw, 256+sym)
+			bw.write(uint64(extra), uint(n))
+			continue
+		}
+		codes[0].emit(&bw, int(t.p[1]))
+		codes[1].emit(&bw, int(t.p[0]))
+		codes[2].emit(&bw, int(t.p[2]))
+		codes[3].emit(&bw, int(t.p[3]))
+	}
+	return bw.bytes(), alpha, nil
+}
+
+// lz77Prefix returns the prefix symbol of the length or distance v, and
+// the number and value of the extra bits that follow it.
+func lz77Prefix(v int) (sym, n, extra int) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	d := v - 1
+	high := bits.Len(uint(d)) - 1
+	n = high - 1
+	return 2*high + d>>n&1, n, d & (1<<n - 1)
+}
+
+// Predictor modes bestPredictor picks from.
+const (
+	predictLeft     = 1
+	predictTop      = 2
+	predictAverage  = 7  // of left and top
+	predictGradient = 12 // left + top - top left, clamped
+)
+
+// bestPredictor returns the predictor mode that leaves the smallest
+// residuals for the image px of the given width.
+func bestPredictor(px [][4]uint8, width int) int {
+	best, bestCost := predictLeft, -1
+	for _, mode := range []int{predictLeft, predictTop, predictAverage, predictGradient} {
+		cost := 0
+		for _, p := range predict(px, width, mode) {
+			for _, v := range p {
+				cost += min(int(v), 256-int(v))
+			}
+		}
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = mode, cost
+		}
+	}
+	return best
+}
+
+// predict returns the residuals of the image px of the given width after
+// the VP8L predictor transform with one mode for every pixel. As the
+// format requires, the first pixel is predicted as opaque black, the rest
+// of the first row from the left and the first column from the top.
+func predict(px [][4]uint8, width, mode int) [][4]uint8 {
+	res := make([][4]uint8, len(px))
+	for i, p := range px {
+		x, y := i%width, i/width
+		var pred [4]uint8
+		switch {
+		case i == 0:
+			pred = [4]uint8{0, 0, 0, 0xff}
+		case y == 0:
+			pred = px[i-1]
+		case x == 0:
+			pred = px[i-width]
+		default:
+			l, t, tl := px[i-1], px[i-width], px[i-width-1]
+			for c := range pred {
+				switch mode {
+				case predictLeft:
+					pred[c] = l[c]
+				case predictTop:
+					pred[c] = t[c]
+				case predictAverage:
+					pred[c] = uint8((int(l[c]) + int(t[c])) / 2)
+				case predictGradient:
+					pred[c] = uint8(min(max(int(l[c])+int(t[c])-int(tl[c]), 0), 255))
+				}
+			}
+		}
+		for c := range p {
+			res[i][c] = p[c] - pred[c]
+		}
+	}
+	return res
+}
+
+// bitWriter packs values least significant bit first, as VP8L does.
+type bitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+func (bw *bitWriter) write(v uint64, n uint) {
+	bw.bits |= v << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.n -= 8
+	}
+}
+
+func (bw *bitWriter) bytes() []byte {
+	if bw.n > 0 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits, bw.n = 0, 0
+	}
+	return bw.buf
+}
+
+// huffCode is a prefix code with the codes stored bit reversed, ready to
+// be written. The decoder reads no bits for a code of a single symbol.
+type huffCode struct {
+	lengths []uint8
+	codes   []uint16
+	single  bool
+}
+
+func (c huffCode) emit(bw *bitWriter, sym int) {
+	if !c.single {
+		bw.write(uint64(c.codes[sym]), uint(c.lengths[sym]))
+	}
+}
+
+// vp8lCodeLengthOrder is the order code length code lengths are written in.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeHuffCode writes a prefix code for symbols with the given counts and
+// returns it.
+func writeHuffCode(bw *bitWriter, counts []int) huffCode {
+	var used []int
+	for sym, n := range counts {
+		if n > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		// A simple code: one symbol takes no bits, two take one each.
+		c := huffCode{make([]uint8, len(counts)), make([]uint16, len(counts)), len(used) == 1}
+		bw.write(1, 1)
+		bw.write(uint64(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint64(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint64(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint64(used[1]), 8)
+			c.lengths[used[0]], c.lengths[used[1]] = 1, 1
+			c.codes[used[1]] = 1
+		}
+		return c
+	}
+
+	c := newHuffCode(counts, 15)
+	clCounts := make([]int, 19)
+	for _, l := range c.lengths {
+		clCounts[l]++
+	}
+	cl := newHuffCode(clCounts, 7)
+	n := 4
+	for i, sym := range vp8lCodeLengthOrder {
+		if cl.lengths[sym] != 0 {
+			n = max(n, i+1)
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint64(n-4), 4)
+	for _, sym := range vp8lCodeLengthOrder[:n] {
+		bw.write(uint64(cl.lengths[sym]), 3)
+	}
+	bw.write(0, 1) // code lengths for the whole alphabet follow
+	for _, l := range c.lengths {
+		cl.emit(bw, int(l))
+	}
+	return c
+}
+
+// newHuffCode returns the canonical prefix code for symbols with the given
+// counts, with codes no longer than limit.
+func newHuffCode(counts []int, limit int) huffCode {
+	c := huffCode{huffLengths(counts, limit), make([]uint16, len(counts)), false}
+	var perLength [16]int
+	nonzero := 0
+	for _, l := range c.lengths {
+		if l > 0 {
+			perLength[l]++
+			nonzero++
+		}
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + perLength[l-1]) << 1
+		next[l] = code
+	}
+	for sym, l := range c.lengths {
+		if l == 0 {
+			continue
+		}
+		v := next[l]
+		next[l]++
+		rev := 0
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | v>>i&1
+		}
+		c.codes[sym] = uint16(rev)
+	}
+	c.single = nonzero == 1
+	return c
+}
+
+// huffLengths returns Huffman code lengths for counts, flattening the
+// counts until no code is longer than limit.
+func huffLengths(counts []int, limit int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	type node struct {
+		count       int
+		left, right int // -1 for a leaf
+		sym         int
+	}
+	for floor := 1; ; floor *= 2 {
+		var nodes []node
+		for sym, n := range counts {
+			if n > 0 {
+				nodes = append(nodes, node{max(n, floor), -1, -1, sym})
+			}
+		}
+		switch len(nodes) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[nodes[0].sym] = 1
+			return lengths
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+		// Merge the two smallest of the sorted leaves and the internal
+		// nodes, which are made in increasing order.
+		leaves := len(nodes)
+		li, ni := 0, leaves
+		smallest := func() int {
+			if li < leaves && (ni >= len(nodes) || nodes[li].count <= nodes[ni].count) {
+				li++
+				return li - 1
+			}
+			ni++
+			return ni - 1
+		}
+		for len(nodes) < 2*leaves-1 {
+			a := smallest()
+			b := smallest()
+			nodes = append(nodes, node{nodes[a].count + nodes[b].count, a, b, -1})
+		}
+
+		depth := make([]int, len(nodes))
+		deepest := 0
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if n := nodes[i]; n.left >= 0 {
+				depth[n.left], depth[n.right] = depth[i]+1, depth[i]+1
+			} else {
+				lengths[n.sym] = uint8(depth[i])
+				deepest = max(deepest, depth[i])
+			}
+		}
+		if deepest <= limit {
+			return lengths
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// webpTestImages returns images of odd sizes, solid and not, with and
+// without alpha, by name.
+func webpTestImages() map[string]image.Image {
+	imgs := map[string]image.Image{}
+	rnd := rand.New(rand.NewPCG(3, 4))
+	for _, size := range []image.Point{{1, 1}, {1, 7}, {7, 1}, {3, 5}, {17, 13}, {64, 33}, {257, 3}} {
+		fill := func(name string, px func(x, y int) color.NRGBA) {
+			img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					img.SetNRGBA(x, y, px(x, y))
+				}
+			}
+			imgs[fmt.Sprintf("%s %dx%d", name, size.X, size.Y)] = img
+		}
+		fill("black", func(x, y int) color.NRGBA { return color.NRGBA{0, 0, 0, 255} })
+		fill("solid", func(x, y int) color.NRGBA { return color.NRGBA{200, 100, 50, 255} })
+		fill("transparent", func(x, y int) color.NRGBA { return color.NRGBA{} })
+		fill("translucent", func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 128} })
+		fill("gradient", func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 255 / size.X), uint8(y * 255 / size.Y), uint8(x + y), uint8(255 - x)}
+		})
+		fill("stripes", func(x, y int) color.NRGBA {
+			if x/3%2 == 0 {
+				return color.NRGBA{255, 255, 255, 255}
+			}
+			return color.NRGBA{0, 0, 255, 255}
+		})
+		fill("noise", func(x, y int) color.NRGBA {
+			v := rnd.Uint32()
+			return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)}
+		})
+	}
+	gray := image.NewGray(image.Rect(2, 3, 13, 10))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	imgs["gray with offset bounds"] = gray
+	imgs["ycbcr"] = image.NewYCbCr(image.Rect(0, 0, 9, 9), image.YCbCrSubsampleRatio420)
+	return imgs
+}
+
+// sameImage reports where got, as decoded, first differs from want, or ""
+// if it doesn't.
+func sameImage(got, want image.Image) string {
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Size() != wb.Size() {
+		return fmt.Sprintf("size %v, want %v", gb.Size(), wb.Size())
+	}
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			w := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			if g != w {
+				return fmt.Sprintf("pixel %d,%d is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return ""
+}
+
+func TestEncodeWebP(t *testing.T) {
+	for name, img := range webpTestImages() {
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, img); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: decoding: %v", name, err)
+			continue
+		}
+		if diff := sameImage(got, img); diff != "" {
+			t.Errorf("%s: %s", name, diff)
+		}
+	}
+}
+
+func TestEncodeWebPSizes(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 1), image.Rect(0, 0, 1, 0), image.Rect(0, 0, 1<<14+1, 1)} {
+		if err := encodeWebP(&bytes.Buffer{}, image.NewNRGBA(r)); err == nil {
+			t.Errorf("%v: no error", r)
+		}
+	}
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	var frames []image.Image
+	for _, name := range []string{"gradient 17x13", "solid 17x13", "transparent 17x13", "noise 17x13"} {
+		frames = append(frames, webpTestImages()[name])
+	}
+	var buf bytes.Buffer
+	if err := encodeAnimatedWebP(&buf, frames, 250*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(b[4:])) != len(b)-8 {
+		t.Fatalf("bad RIFF header % x", b[:12])
+	}
+
+	// x/image can't decode animations, so decode each frame as a still
+	// image of its own.
+	var chunks []string
+	n := 0
+	for rest := b[12:]; len(rest) > 0; {
+		fourcc, size := string(rest[:4]), int(binary.LittleEndian.Uint32(rest[4:]))
+		data := rest[8 : 8+size]
+		rest = rest[8+size+size&1:]
+		chunks = append(chunks, fourcc)
+		switch fourcc {
+		case "VP8X":
+			if data[0] != 0x12 || data[4]+1 != 17 || data[7]+1 != 13 {
+				t.Errorf("VP8X % x: want animation with alpha of 17x13", data)
+			}
+		case "ANMF":
+			if delay := int(data[12]) | int(data[13])<<8; delay != 250 {
+				t.Errorf("frame %d shows for %dms", n, delay)
+			}
+			var still bytes.Buffer
+			writeWebP(&still, data[16:])
+			got, err := webp.Decode(&still)
+			if err != nil {
+				t.Fatalf("frame %d: %v", n, err)
+			}
+			if diff := sameImage(got, frames[n]); diff != "" {
+				t.Errorf("frame %d: %s", n, diff)
+			}
+			n++
+		}
+	}
+	if want := "[VP8X ANIM ANMF ANMF ANMF ANMF]"; fmt.Sprint(chunks) != want {
+		t.Errorf("chunks %v, want %s", chunks, want)
+	}
+
+	if err := encodeAnimatedWebP(&buf, append(frames, webpTestImages()["solid 3x5"]), time.Second); err == nil {
+		t.Errorf("frames of different sizes: no error")
+	}
+}